@@ -0,0 +1,60 @@
+package wsecho
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Abort is a way to end connections abruptly, without a close frame.
+type Abort string
+
+const (
+	// AbortFIN closes the TCP connection gracefully with a FIN.
+	AbortFIN Abort = "fin"
+	// AbortRST resets the TCP connection with a RST.
+	AbortRST Abort = "rst"
+)
+
+// WithAbort ends connections abruptly instead of closing them with a close
+// frame once the limits set by WithCloseAfter are reached, or right after
+// the upgrade without limits, so clients can be tested against dirty
+// disconnects. Clients can set it for their connection with the abort query
+// parameter, e.g. ?abort=rst&close_after=3.
+func WithAbort(a Abort) Option {
+	return func(s *Server) {
+		s.params.abort = a
+	}
+}
+
+// ParseAbort parses the name of an abort.
+func ParseAbort(s string) (Abort, error) {
+	switch a := Abort(s); a {
+	case AbortFIN, AbortRST:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown abort %q", s)
+	}
+}
+
+// abort closes the underlying TCP connection without sending a close frame
+// nor, for TLS connections, a close notify alert.
+func abort(conn net.Conn, a Abort) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.NetConn()
+	}
+	if a == AbortRST {
+		tc, ok := conn.(*net.TCPConn)
+		if !ok {
+			return fmt.Errorf("can't reset %T connections", conn)
+		}
+		// Discard unsent data and send a RST on close.
+		if err := tc.SetLinger(0); err != nil {
+			return fmt.Errorf("couldn't set linger: %w", err)
+		}
+	}
+	return conn.Close()
+}
@@ -0,0 +1,65 @@
+package wsecho
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLog writes an entry in JSON lines format for each upgrade request.
+// All methods are no-ops on a nil receiver.
+type accessLog struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	logger *slog.Logger
+}
+
+func newAccessLog(w io.Writer) *accessLog {
+	return &accessLog{enc: json.NewEncoder(w), logger: slog.Default()}
+}
+
+// accessEntry is an access log entry.
+type accessEntry struct {
+	Time        time.Time     `json:"time"`
+	Conn        uint64        `json:"conn"`
+	RemoteAddr  string        `json:"remote_addr"`
+	Path        string        `json:"path"`
+	Proto       string        `json:"proto"`
+	Origin      string        `json:"origin,omitempty"`
+	UserAgent   string        `json:"user_agent,omitempty"`
+	Subprotocol string        `json:"subprotocol,omitempty"`
+	Upgraded    bool          `json:"upgraded"`
+	Duration    time.Duration `json:"duration"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// log writes an entry for the request r of the connection id started at
+// start.
+func (a *accessLog) log(r *http.Request, id uint64, start time.Time, subprotocol string, upgraded bool, err error) {
+	if a == nil {
+		return
+	}
+	e := accessEntry{
+		Time:        start,
+		Conn:        id,
+		RemoteAddr:  r.RemoteAddr,
+		Path:        r.URL.Path,
+		Proto:       r.Proto,
+		Origin:      r.Header.Get("Origin"),
+		UserAgent:   r.UserAgent(),
+		Subprotocol: subprotocol,
+		Upgraded:    upgraded,
+		Duration:    time.Since(start),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		a.logger.Error("couldn't write access log", "error", err)
+	}
+}
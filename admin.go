@@ -0,0 +1,235 @@
+package wsecho
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errUnknownConn is returned when closing a connection that isn't live.
+var errUnknownConn = errors.New("unknown connection")
+
+// WithAdmin serves the admin API on a separate address, requiring the token
+// as a bearer token in the Authorization header. The token is required, the
+// admin API can close connections and drain the server.
+func WithAdmin(addr, token string) Option {
+	return func(s *Server) {
+		s.adminAddr = addr
+		s.adminToken = token
+	}
+}
+
+// ConnInfo describes a live websocket connection.
+// Durations are encoded to JSON as nanoseconds.
+type ConnInfo struct {
+	// ID is the id of the connection, as logged by the server.
+	ID uint64 `json:"id"`
+	// RemoteAddr is the address of the client, or of the last proxy.
+	RemoteAddr string `json:"remote_addr"`
+	// URI is the path of the upgrade request, without the query that may
+	// hold credentials.
+	URI string `json:"uri"`
+	// Proto is the HTTP version of the upgrade request, HTTP/2.0 for
+	// websockets bootstrapped with extended CONNECT.
+	Proto string `json:"proto"`
+	// Started is the time the connection was upgraded.
+	Started time.Time `json:"started"`
+	// Uptime is the time since the connection was upgraded.
+	Uptime time.Duration `json:"uptime"`
+	// MessagesReceived is the number of messages received from the client.
+	MessagesReceived int64 `json:"messages_received"`
+	// MessagesSent is the number of messages sent to the client.
+	MessagesSent int64 `json:"messages_sent"`
+	// BytesReceived is the number of payload bytes received.
+	BytesReceived int64 `json:"bytes_received"`
+	// BytesSent is the number of payload bytes sent.
+	BytesSent int64 `json:"bytes_sent"`
+}
+
+// connStats counts the messages of a connection. A nil *connStats discards
+// them.
+type connStats struct {
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+	bytesReceived    atomic.Int64
+	bytesSent        atomic.Int64
+}
+
+// received counts a message of n bytes received from the client.
+func (c *connStats) received(n int) {
+	if c == nil {
+		return
+	}
+	c.messagesReceived.Add(1)
+	c.bytesReceived.Add(int64(n))
+}
+
+// sent counts a message of n bytes sent to the client.
+func (c *connStats) sent(n int) {
+	if c == nil {
+		return
+	}
+	c.messagesSent.Add(1)
+	c.bytesSent.Add(int64(n))
+}
+
+// Connections returns the live websocket connections sorted by id.
+func (s *Server) Connections() []ConnInfo {
+	conns := s.tracker.live()
+	infos := make([]ConnInfo, 0, len(conns))
+	now := time.Now()
+	for _, c := range conns {
+		infos = append(infos, ConnInfo{
+			ID:               c.id,
+			RemoteAddr:       c.remoteAddr,
+			URI:              c.uri,
+			Proto:            c.proto,
+			Started:          c.start,
+			Uptime:           now.Sub(c.start),
+			MessagesReceived: c.stats.messagesReceived.Load(),
+			MessagesSent:     c.stats.messagesSent.Load(),
+			BytesReceived:    c.stats.bytesReceived.Load(),
+			BytesSent:        c.stats.bytesSent.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseConn closes the live connection with the id, sending a close frame
+// with the code and reason.
+func (s *Server) CloseConn(id uint64, code int, reason string) error {
+	if !validCloseCode(code) {
+		return fmt.Errorf("invalid close code %d", code)
+	}
+	if len(reason) > maxCloseReason {
+		return fmt.Errorf("reason longer than %d bytes", maxCloseReason)
+	}
+	c := s.tracker.get(id)
+	if c == nil {
+		return fmt.Errorf("%w %d", errUnknownConn, id)
+	}
+	c.close(code, reason)
+	return nil
+}
+
+// AdminHandler returns an http.Handler serving the admin API:
+//
+//	GET /connections              lists the live connections as ConnInfo
+//	DELETE /connections/{id}      closes a connection, with the optional
+//	                              code and reason query parameters
+//	POST /drain                   drains the server, see Drain
+//
+// Requests must present the token set by WithAdmin as a bearer token, all
+// requests are refused without it.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.Connections())
+	})
+	mux.HandleFunc("/connections/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		code := websocket.CloseNormalClosure
+		if v := r.URL.Query().Get("code"); v != "" {
+			code, err = strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid code %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := s.CloseConn(id, code, r.URL.Query().Get("reason")); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errUnknownConn) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		forced := s.Drain(r.Context())
+		writeJSON(w, struct {
+			Forced int `json:"forced"`
+		}{Forced: forced})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wsecho admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized returns true if the request presents the admin token as
+// a bearer token.
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(s.adminToken)) == 1
+}
+
+// serveAdmin serves the admin API until the context is cancelled, if it
+// is enabled.
+func (s *Server) serveAdmin(ctx context.Context) error {
+	if s.adminAddr == "" {
+		return nil
+	}
+	if s.adminToken == "" {
+		return errors.New("missing admin token")
+	}
+	ln, err := listen(s.adminAddr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("admin listening", "addr", ln.Addr().String())
+	go func() {
+		if err := serveHandler(ctx, []listener{httpListener(ln)}, s.AdminHandler(), s.logger, nil); err != nil {
+			s.logger.Error("couldn't serve admin", "error", err)
+		}
+	}()
+	return nil
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(data, '\n'))
+}
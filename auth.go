@@ -0,0 +1,105 @@
+package wsecho
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// errUnauthorized is returned when the upgrade request isn't authorized.
+var errUnauthorized = errors.New("unauthorized")
+
+// WithTokens requires clients to present one of the tokens on the upgrade
+// request, either as a bearer token in the Authorization header or in the
+// token query parameter. Unauthorized requests are rejected with 401.
+func WithTokens(tokens ...string) Option {
+	return func(s *Server) {
+		s.tokens = tokens
+	}
+}
+
+// WithBasicAuth requires clients to authenticate with HTTP basic auth on
+// the upgrade request. Unauthorized requests are rejected with 401.
+func WithBasicAuth(username, password string) Option {
+	return func(s *Server) {
+		s.basicAuth = &basicAuth{username: username, password: password}
+	}
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+// authorize checks the credentials of the upgrade request, writing the
+// challenge headers to w if they are missing or invalid. Requests are
+// authorized if any of the configured methods succeeds. The claims of the
+// token are returned if it was authorized with a JSON web token.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, error) {
+	if len(s.tokens) == 0 && s.basicAuth == nil && s.jwt == nil {
+		return nil, nil
+	}
+	err := errUnauthorized
+	if len(s.tokens) > 0 || s.jwt != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="wsecho"`)
+	}
+	if len(s.tokens) > 0 && s.validToken(r) {
+		return nil, nil
+	}
+	if s.jwt != nil {
+		if token := bearerToken(r); token != "" {
+			claims, jwtErr := s.jwt.validate(token)
+			if jwtErr == nil {
+				return claims, nil
+			}
+			err = fmt.Errorf("%w: %w", errUnauthorized, jwtErr)
+		}
+	}
+	if s.basicAuth != nil {
+		if s.validBasicAuth(r) {
+			return nil, nil
+		}
+		w.Header().Add("WWW-Authenticate", `Basic realm="wsecho", charset="UTF-8"`)
+	}
+	return nil, err
+}
+
+func (s *Server) validBasicAuth(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare both values to avoid leaking which one is wrong.
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.basicAuth.username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.basicAuth.password)) == 1
+	return userOK && passOK
+}
+
+// bearerToken returns the bearer token of the Authorization header or the
+// token query parameter.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, t, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(t)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (s *Server) validToken(r *http.Request) bool {
+	token := bearerToken(r)
+	if token == "" {
+		return false
+	}
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
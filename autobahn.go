@@ -0,0 +1,143 @@
+package wsecho
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// WithAutobahn enables the behaviors checked by the Autobahn TestSuite,
+// overriding the options disabling them. Text messages are always validated
+// as UTF-8.
+func WithAutobahn(enabled bool) Option {
+	return func(s *Server) {
+		s.autobahn = enabled
+	}
+}
+
+// AutobahnCase is the result of an Autobahn TestSuite case.
+type AutobahnCase struct {
+	// ID is the identifier of the case, e.g. 1.1.1.
+	ID string `json:"id"`
+	// Description describes what the case tests.
+	Description string `json:"description"`
+	// Behavior is the result of the case, e.g. OK, NON-STRICT,
+	// INFORMATIONAL, UNIMPLEMENTED or FAILED.
+	Behavior string `json:"behavior"`
+}
+
+// RunAutobahn runs every case of the Autobahn TestSuite fuzzingserver at
+// host, e.g. ws://localhost:9001, with an echo client identified as agent.
+// The reports of the fuzzingserver are updated once all the cases ran and
+// the result of each case is returned. The default slog logger is used if
+// logger is nil.
+func RunAutobahn(ctx context.Context, host, agent string, logger *slog.Logger) ([]AutobahnCase, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	host = strings.TrimSuffix(host, "/")
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+
+	// Get the number of cases.
+	var count int
+	if err := autobahnQuery(ctx, dialer, host+"/getCaseCount", func(data []byte) error {
+		n, err := strconv.Atoi(string(data))
+		count = n
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("couldn't get case count: %w", err)
+	}
+	logger.Info("running autobahn cases", "count", count)
+
+	var cases []AutobahnCase
+	for i := 1; i <= count; i++ {
+		q := url.Values{"case": {strconv.Itoa(i)}, "agent": {agent}}
+		var c AutobahnCase
+		if err := autobahnQuery(ctx, dialer, host+"/getCaseInfo?"+q.Encode(), func(data []byte) error {
+			return json.Unmarshal(data, &c)
+		}); err != nil {
+			return cases, fmt.Errorf("couldn't get case %d info: %w", i, err)
+		}
+		if err := autobahnEcho(ctx, dialer, host+"/runCase?"+q.Encode()); err != nil {
+			logger.Debug("case connection ended", "case", c.ID, "error", err)
+		}
+		if err := autobahnQuery(ctx, dialer, host+"/getCaseStatus?"+q.Encode(), func(data []byte) error {
+			return json.Unmarshal(data, &c)
+		}); err != nil {
+			return cases, fmt.Errorf("couldn't get case %d status: %w", i, err)
+		}
+		logger.Info("case", "id", c.ID, "behavior", c.Behavior)
+		cases = append(cases, c)
+	}
+
+	q := url.Values{"agent": {agent}}
+	if err := autobahnQuery(ctx, dialer, host+"/updateReports?"+q.Encode(), nil); err != nil {
+		return cases, fmt.Errorf("couldn't update reports: %w", err)
+	}
+	return cases, nil
+}
+
+// autobahnQuery connects to a fuzzingserver endpoint and passes each text
+// message received to handle until the server closes the connection.
+func autobahnQuery(ctx context.Context, dialer *websocket.Dialer, u string, handle func([]byte) error) error {
+	conn, _, err := dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't dial: %w", err)
+	}
+	defer conn.Close()
+	for {
+		_, data, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't read: %w", err)
+		}
+		if handle != nil {
+			if err := handle(data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// autobahnEcho echoes the messages of a fuzzingserver case until the
+// connection is closed.
+func autobahnEcho(ctx context.Context, dialer *websocket.Dialer, u string) error {
+	conn, _, err := dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't dial: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	for {
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if mt == websocket.TextMessage && !utf8.Valid(data) {
+			msg := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return errInvalidUTF8
+		}
+		if err := conn.WriteMessage(mt, data); err != nil {
+			return err
+		}
+	}
+}
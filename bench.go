@@ -0,0 +1,56 @@
+package wsecho
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// BenchResult is the result of pinging the benchmark server with a message
+// size and number of connections.
+type BenchResult struct {
+	// Size is the size in bytes of the messages sent.
+	Size int `json:"size"`
+	// Connections is the number of parallel connections.
+	Connections int `json:"connections"`
+	*Result
+}
+
+// Bench serves an in-process echo server on a loopback address and pings it
+// with every combination of message sizes and number of connections,
+// returning the results of each run. Server and ping options apply to all
+// the runs, the server doesn't log unless a logger is provided and size and
+// connection options are overridden.
+func Bench(ctx context.Context, sizes, connections []int, serverOpts []Option, pingOpts ...PingOption) ([]BenchResult, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	errC := make(chan error, 1)
+	serverOpts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, serverOpts...)
+	go func() {
+		errC <- ServeListener(ctx, ln, serverOpts...)
+	}()
+	defer func() {
+		cancel()
+		<-errC
+	}()
+
+	host := "ws://" + ln.Addr().String()
+	var results []BenchResult
+	for _, c := range connections {
+		for _, size := range sizes {
+			opts := append([]PingOption{WithVerbosity(VerbosityQuiet)}, pingOpts...)
+			opts = append(opts, WithSize(size), WithConnections(c))
+			r, err := Ping(ctx, host, opts...)
+			if err != nil {
+				return results, fmt.Errorf("couldn't ping %d connections with %d bytes: %w", c, size, err)
+			}
+			results = append(results, BenchResult{Size: size, Connections: c, Result: r})
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,213 @@
+package wsecho
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultBroadcastQueue is the default number of messages queued for each
+// broadcast client.
+const defaultBroadcastQueue = 64
+
+// WithBroadcastQueue sets the number of messages queued to be sent to each
+// broadcast client. Messages for clients with a full queue are dropped, so
+// slow clients don't slow down the others. The default is 64.
+func WithBroadcastQueue(n int) Option {
+	return func(s *Server) {
+		s.broadcastQueue = n
+	}
+}
+
+// BroadcastHandler returns an http.Handler serving websocket connections
+// whose messages are sent to all the other clients in the same room instead
+// of echoed, so the server can stand in for a pub/sub hub. The room of a
+// connection is the room query parameter, or the request path without the
+// /broadcast/ prefix if it isn't set, so /broadcast/room1 and
+// /broadcast?room=room1 join the same room.
+func (s *Server) BroadcastHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMode(w, r, modeBroadcast)
+	})
+}
+
+// pathRoom returns the room of the request path, trimming the /broadcast/
+// prefix so /broadcast and /broadcast/ are the same room.
+func pathRoom(path string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, "/broadcast"), "/")
+}
+
+// hub fans out messages to the subscribers of each room.
+type hub struct {
+	mu    sync.Mutex
+	rooms map[string]map[*subscriber]struct{}
+}
+
+// subscriber is a broadcast client.
+type subscriber struct {
+	room string
+	send chan hubMessage
+}
+
+// hubMessage is a message sent through the hub.
+type hubMessage struct {
+	mt   int
+	data []byte
+}
+
+func newHub() *hub {
+	return &hub{rooms: map[string]map[*subscriber]struct{}{}}
+}
+
+// add adds the subscriber to its room, returning the number of subscribers
+// in the room.
+func (h *hub) add(sub *subscriber) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.rooms[sub.room]
+	if subs == nil {
+		subs = map[*subscriber]struct{}{}
+		h.rooms[sub.room] = subs
+	}
+	subs[sub] = struct{}{}
+	return len(subs)
+}
+
+// remove removes the subscriber from its room, removing the room once it is
+// empty.
+func (h *hub) remove(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.rooms[sub.room]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.rooms, sub.room)
+	}
+}
+
+// publish queues the message for every subscriber in the room of the sender
+// but the sender, returning the number of subscribers it was queued for and
+// the number of subscribers it was dropped for because their queue is full.
+func (h *hub) publish(from *subscriber, m hubMessage) (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var queued, dropped int
+	for sub := range h.rooms[from.room] {
+		if sub == from {
+			continue
+		}
+		select {
+		case sub.send <- m:
+			queued++
+		default:
+			dropped++
+		}
+	}
+	return queued, dropped
+}
+
+// broadcast sends the messages of the connection to the other clients in its
+// room and their messages to the connection until it is closed,
+// returning the error that ended it.
+func (s *Server) broadcast(c *session) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	sub := &subscriber{
+		room: c.params.room,
+		send: make(chan hubMessage, s.broadcastQueue),
+	}
+	n := s.hub.add(sub)
+	defer s.hub.remove(sub)
+	c.logger.Info("joined room", "room", sub.room, "clients", n)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		err := s.forward(ctx, c, sub)
+		if err != nil {
+			// Stop reading.
+			cancel()
+			_ = c.conn.SetReadDeadline(time.Now())
+		}
+		writeErr <- err
+	}()
+	err := s.publish(ctx, c, sub)
+	cancel()
+	if werr := <-writeErr; werr != nil {
+		return werr
+	}
+	return err
+}
+
+// publish reads the messages of the connection and publishes them to the
+// hub.
+func (s *Server) publish(ctx context.Context, c *session, sub *subscriber) error {
+	conn, logger := c.conn, c.logger
+	debug := logger.Enabled(ctx, slog.LevelDebug)
+	for {
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return err
+			}
+		}
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		if c.params.readLimiter != nil {
+			r = &throttledReader{ctx: ctx, r: r, limiter: c.params.readLimiter}
+		}
+		// The message is shared by the subscribers, it can't reuse a buffer.
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		c.live.active()
+		c.stats.received(len(data))
+		if s.invalidUTF8(mt, data) {
+			s.vars.failed()
+			logger.Warn("invalid UTF-8", "bytes", len(data))
+			c.closeConn(websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+			return errInvalidUTF8
+		}
+		queued, dropped := s.hub.publish(sub, hubMessage{mt: mt, data: data})
+		if dropped > 0 {
+			logger.Warn("broadcast queues full, message dropped", "bytes", len(data), "dropped", dropped)
+		}
+		if debug {
+			logger.Debug("broadcast", "bytes", len(data), "queued", queued)
+		}
+	}
+}
+
+// forward writes the messages queued for the subscriber to the connection.
+func (s *Server) forward(ctx context.Context, c *session, sub *subscriber) error {
+	conn, logger := c.conn, c.logger
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-sub.send:
+			start := time.Now()
+			if err := s.setWriteDeadline(conn); err != nil {
+				logger.Error("couldn't set write deadline", "error", err)
+				return err
+			}
+			if err := conn.WriteMessage(m.mt, m.data); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return s.writeError(logger, err)
+			}
+			s.metrics.echoed(len(m.data), time.Since(start))
+			s.vars.echoed(len(m.data), time.Since(start))
+			c.stats.sent(len(m.data))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package wsecho
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CaptureRecord is a message received by the server, as written to the
+// capture in JSON lines format.
+type CaptureRecord struct {
+	Time    time.Time `json:"time"`
+	Conn    uint64    `json:"conn"`
+	Type    int       `json:"type"`
+	Payload []byte    `json:"payload"`
+}
+
+// ReadCapture reads the records of a capture written by the server.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec CaptureRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't decode capture record %d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// capture writes the messages received by a server.
+// All methods are no-ops on a nil receiver.
+type capture struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	logger *slog.Logger
+}
+
+func newCapture(w io.Writer) *capture {
+	return &capture{enc: json.NewEncoder(w), logger: slog.Default()}
+}
+
+func (c *capture) record(conn uint64, mt int, data []byte) {
+	if c == nil {
+		return
+	}
+	rec := CaptureRecord{
+		Time:    time.Now(),
+		Conn:    conn,
+		Type:    mt,
+		Payload: data,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(rec); err != nil {
+		c.logger.Error("couldn't write capture", "error", err)
+	}
+}
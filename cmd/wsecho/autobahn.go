@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/igolaizola/wsecho"
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newAutobahnCommand() *ffcli.Command {
+	cmd := "autobahn"
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	_ = fs.String("config", "", "config file (optional)")
+
+	host := fs.String("host", "ws://localhost:9001", "address of the Autobahn TestSuite fuzzingserver")
+	agent := fs.String("agent", "wsecho", "agent name used in the fuzzingserver reports")
+	output := fs.String("output", "text", "output format, text or json")
+	logLevel := fs.String("log-level", "info", "log level, debug, info, warn or error")
+	logFormat := fs.String("log-format", "text", "log format, text or json")
+
+	return &ffcli.Command{
+		Name:       cmd,
+		ShortUsage: fmt.Sprintf("wsecho %s [flags] <key> <value data...>", cmd),
+		Options: []ff.Option{
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ff.PlainParser),
+			ff.WithEnvVarPrefix("WSECHO"),
+		},
+		ShortHelp: fmt.Sprintf("wsecho %s command", cmd),
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			logger, err := newLogger(*logLevel, *logFormat)
+			if err != nil {
+				return err
+			}
+			if *host == "" {
+				return errors.New("missing host")
+			}
+			if *output != "text" && *output != "json" {
+				return fmt.Errorf("invalid output format %q", *output)
+			}
+			cases, err := wsecho.RunAutobahn(ctx, *host, *agent, logger)
+			if *output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(cases); err != nil {
+					return fmt.Errorf("couldn't encode cases: %w", err)
+				}
+				return err
+			}
+
+			// Print the cases that didn't pass and the count of each behavior.
+			counts := map[string]int{}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, c := range cases {
+				counts[c.Behavior]++
+				if c.Behavior != "OK" {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", c.ID, c.Behavior, c.Description)
+				}
+			}
+			behaviors := make([]string, 0, len(counts))
+			for b := range counts {
+				behaviors = append(behaviors, b)
+			}
+			sort.Strings(behaviors)
+			fmt.Fprintln(w)
+			for _, b := range behaviors {
+				fmt.Fprintf(w, "%s\t%d\n", b, counts[b])
+			}
+			if err := w.Flush(); err != nil {
+				return fmt.Errorf("couldn't write report: %w", err)
+			}
+			if err == nil && counts["FAILED"] > 0 {
+				return fmt.Errorf("%d cases failed", counts["FAILED"])
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/gorilla/websocket"
+	"github.com/igolaizola/wsecho"
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newBenchCommand() *ffcli.Command {
+	cmd := "bench"
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	_ = fs.String("config", "", "config file (optional)")
+
+	sizes := fs.String("sizes", "32,1024,16384,65536", "comma separated message sizes in bytes")
+	connections := fs.String("connections", "1,10,100", "comma separated numbers of parallel connections")
+	n := fs.Int("n", 1000, "number of messages to send on each connection for each run")
+	duration := fs.Duration("duration", 0, "time to run each combination, overrides n if set")
+	window := fs.Int("window", 1, "messages in flight per connection")
+	text := fs.Bool("text", false, "send text messages instead of binary")
+	library := fs.String("library", "", "websocket library used by the server (gorilla, coder), defaults to the one selected at build time")
+	netpoll := fs.Bool("netpoll", false, "serve connections with the netpoll backend")
+	compression := fs.Bool("compression", false, "enable permessage-deflate compression")
+	output := fs.String("output", "text", "output format, text or json")
+	logLevel := fs.String("log-level", "warn", "log level, debug, info, warn or error")
+	logFormat := fs.String("log-format", "text", "log format, text or json")
+
+	return &ffcli.Command{
+		Name:       cmd,
+		ShortUsage: fmt.Sprintf("wsecho %s [flags] <key> <value data...>", cmd),
+		Options: []ff.Option{
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ff.PlainParser),
+			ff.WithEnvVarPrefix("WSECHO"),
+		},
+		ShortHelp: fmt.Sprintf("wsecho %s command", cmd),
+		FlagSet:   fs,
+		Exec: func(ctx context.Context, args []string) error {
+			logger, err := newLogger(*logLevel, *logFormat)
+			if err != nil {
+				return err
+			}
+			sizeList, err := parseInts(*sizes)
+			if err != nil {
+				return fmt.Errorf("invalid sizes: %w", err)
+			}
+			connList, err := parseInts(*connections)
+			if err != nil {
+				return fmt.Errorf("invalid connections: %w", err)
+			}
+			if *n < 1 && *duration <= 0 {
+				return errors.New("n must be greater than 0")
+			}
+			if *window < 1 {
+				return errors.New("window must be greater than 0")
+			}
+			if *output != "text" && *output != "json" {
+				return fmt.Errorf("invalid output format %q", *output)
+			}
+
+			opts := []wsecho.Option{
+				wsecho.WithLogger(logger),
+				wsecho.WithCompression(*compression),
+			}
+			if *library != "" {
+				lib, err := parseLibrary(*library)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, wsecho.WithLibrary(lib))
+			}
+			if *netpoll {
+				opts = append(opts, wsecho.WithNetpoll(true))
+			}
+			pingOpts := []wsecho.PingOption{
+				wsecho.WithPingLogger(logger),
+				wsecho.WithCount(*n),
+				wsecho.WithDuration(*duration),
+				wsecho.WithWindow(*window),
+			}
+			if *text {
+				pingOpts = append(pingOpts, wsecho.WithMessageType(websocket.TextMessage))
+			}
+			if *compression {
+				pingOpts = append(pingOpts, wsecho.WithPingCompression(wsecho.CompressionEnabled))
+			}
+
+			results, err := wsecho.Bench(ctx, sizeList, connList, opts, pingOpts...)
+			if *output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(results); err != nil {
+					return fmt.Errorf("couldn't encode results: %w", err)
+				}
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+			fmt.Fprintln(w, "size\tconns\tmessages\tmsg/s\tMB/s\tp50\tp90\tp99\tmax\tfailed\t")
+			for _, r := range results {
+				fmt.Fprintf(w, "%d\t%d\t%d\t%.0f\t%.2f\t%s\t%s\t%s\t%s\t%d\t\n",
+					r.Size, r.Connections, len(r.RTTs), r.MessageRate, r.Throughput/1e6,
+					r.P50, r.P90, r.P99, r.Max, r.Errors+r.Mismatches+r.Timeouts)
+			}
+			if err := w.Flush(); err != nil {
+				return fmt.Errorf("couldn't write report: %w", err)
+			}
+			return err
+		},
+	}
+}
+
+// parseInts parses a comma separated list of positive integers.
+func parseInts(s string) ([]int, error) {
+	var ints []int
+	for _, v := range splitList(s) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		if i < 1 {
+			return nil, fmt.Errorf("%d must be greater than 0", i)
+		}
+		ints = append(ints, i)
+	}
+	if len(ints) == 0 {
+		return nil, errors.New("empty list")
+	}
+	return ints, nil
+}
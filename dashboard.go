@@ -0,0 +1,124 @@
+package wsecho
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// dashboardInterval is the interval between the samples sent to the
+// dashboard.
+const dashboardInterval = time.Second
+
+// WithDashboard enables serving a live dashboard of the server, served by
+// DashboardHandler.
+func WithDashboard(enabled bool) Option {
+	return func(s *Server) {
+		s.dashboard = enabled
+	}
+}
+
+// dashboardSample is the activity of the server since the previous sample.
+type dashboardSample struct {
+	Time              time.Time `json:"time"`
+	ActiveConnections int       `json:"active_connections"`
+	MessageRate       float64   `json:"message_rate"`
+	Throughput        float64   `json:"throughput"`
+	Latency           float64   `json:"latency_us"`
+	Errors            int64     `json:"errors"`
+}
+
+// dashboardCounters are the counters the samples are computed from.
+type dashboardCounters struct {
+	time     time.Time
+	messages int64
+	bytes    int64
+	nanos    int64
+}
+
+func (s *Server) dashboardCounters() dashboardCounters {
+	return dashboardCounters{
+		time:     time.Now(),
+		messages: s.vars.messages.Value(),
+		bytes:    s.vars.bytes.Value(),
+		nanos:    s.vars.echoNanoseconds.Value(),
+	}
+}
+
+// DashboardHandler returns an http.Handler serving a live dashboard with the
+// connection count, message rate, throughput and echo latency of the server
+// on /dashboard, fed with samples over a websocket on /dashboard/ws, or nil
+// if the dashboard is disabled. Dashboard connections aren't counted.
+func (s *Server) DashboardHandler() http.Handler {
+	if !s.dashboard {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(dashboardPage)
+	})
+	mux.HandleFunc("/dashboard/ws", s.serveDashboard)
+	return mux
+}
+
+// serveDashboard sends a sample to the dashboard every interval until the
+// connection is closed.
+func (s *Server) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	// Only the page served by the server connects, so the default same
+	// origin check applies.
+	var upgrader websocket.Upgrader
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("couldn't upgrade dashboard", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Read in the background to handle control messages.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	prev := s.dashboardCounters()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur := s.dashboardCounters()
+		elapsed := cur.time.Sub(prev.time).Seconds()
+		messages := cur.messages - prev.messages
+		sample := dashboardSample{
+			Time:              cur.time,
+			ActiveConnections: len(s.tracker.live()),
+			MessageRate:       float64(messages) / elapsed,
+			Throughput:        float64(cur.bytes-prev.bytes) / elapsed,
+			Errors:            s.vars.errors.Value(),
+		}
+		if messages > 0 {
+			sample.Latency = float64(cur.nanos-prev.nanos) / float64(messages) / 1e3
+		}
+		prev = cur
+		_ = conn.SetWriteDeadline(time.Now().Add(dashboardInterval))
+		if err := conn.WriteJSON(sample); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package wsecho
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Distribution is a probability distribution of the jitter of echoes.
+type Distribution string
+
+const (
+	// DistributionUniform spreads delays evenly within the jitter around
+	// the mean.
+	DistributionUniform Distribution = "uniform"
+	// DistributionNormal spreads delays normally around the mean, with the
+	// jitter as standard deviation.
+	DistributionNormal Distribution = "normal"
+)
+
+// Corruption is the way payloads are corrupted.
+type Corruption string
+
+const (
+	// CorruptionFlip flips a random bit of the payload.
+	CorruptionFlip Corruption = "flip"
+	// CorruptionTruncate truncates the payload at a random length.
+	CorruptionTruncate Corruption = "truncate"
+)
+
+// throttleBurst is the maximum number of bytes written at once by throttled
+// connections.
+const throttleBurst = 4096
+
+// WithEchoDelay delays each echo by d. Clients can set the delay of their
+// connection with the delay query parameter, e.g. ?delay=250ms. Echoes are
+// sent in order, so delays add up for clients that send messages without
+// waiting for their echoes.
+func WithEchoDelay(d time.Duration) Option {
+	return func(s *Server) {
+		s.params.delay = d
+	}
+}
+
+// WithEchoJitter randomizes the delay of each echo following the
+// distribution around the mean set by WithEchoDelay. Delays are never
+// negative. Clients can set the jitter and distribution of their connection
+// with the jitter and distribution query parameters, e.g.
+// ?delay=100ms&jitter=20ms&distribution=normal.
+func WithEchoJitter(jitter time.Duration, dist Distribution) Option {
+	return func(s *Server) {
+		s.params.jitter = jitter
+		s.params.distribution = dist
+	}
+}
+
+// WithDrop drops the percentage of messages instead of echoing them, from 0
+// to 100. Clients can set the percentage of their connection with the drop
+// query parameter, e.g. ?drop=10.
+func WithDrop(percent float64) Option {
+	return func(s *Server) {
+		s.params.drop = percent
+	}
+}
+
+// WithCorruption corrupts the payload of the percentage of echoes, from 0
+// to 100, so clients can validate their integrity checks. Corrupted text
+// echoes may not be valid UTF-8. Clients can set the percentage and
+// corruption of their connection with the corrupt and corruption query
+// parameters, e.g. ?corrupt=10&corruption=truncate.
+func WithCorruption(percent float64, c Corruption) Option {
+	return func(s *Server) {
+		s.params.corrupt = percent
+		s.params.corruption = c
+	}
+}
+
+// WithBandwidth throttles the echoes of each connection to the bandwidth in
+// bytes per second, so clients can be tested against slow links. Write
+// timeouts must allow for the time to write the largest messages. Clients can
+// set the bandwidth of their connection with the bandwidth query parameter,
+// e.g. ?bandwidth=16384.
+func WithBandwidth(bytesPerSecond int) Option {
+	return func(s *Server) {
+		s.params.bandwidth = bytesPerSecond
+	}
+}
+
+// WithReadBandwidth reads the messages of each connection at the bandwidth
+// in bytes per second, so the socket buffers fill up and TCP backpressure
+// slows down clients sending faster. Clients can set the read bandwidth of
+// their connection with the read_bandwidth query parameter, e.g.
+// ?read_bandwidth=1024.
+func WithReadBandwidth(bytesPerSecond int) Option {
+	return func(s *Server) {
+		s.params.readBandwidth = bytesPerSecond
+	}
+}
+
+// WithEchoRepeat echoes each message n times, waiting for the interval
+// between echoes, so clients can be tested against servers that push more
+// than they receive. Clients can set the repetitions of their connection with
+// the repeat and repeat_interval query parameters, e.g.
+// ?repeat=10&repeat_interval=100ms.
+func WithEchoRepeat(n int, interval time.Duration) Option {
+	return func(s *Server) {
+		s.params.repeat = n
+		s.params.repeatInterval = interval
+	}
+}
+
+// WithFaultSeed seeds the random faults injected into echoes, so they can
+// be reproduced. Each connection is seeded with the seed plus its id, unless
+// the client sets the seed of the connection with the seed query parameter.
+// A random seed is used by default.
+func WithFaultSeed(seed int64) Option {
+	return func(s *Server) {
+		s.params.seed = seed
+	}
+}
+
+// ParseDistribution parses the name of a distribution.
+func ParseDistribution(s string) (Distribution, error) {
+	switch d := Distribution(s); d {
+	case DistributionUniform, DistributionNormal:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown distribution %q", s)
+	}
+}
+
+// ParseCorruption parses the name of a corruption.
+func ParseCorruption(s string) (Corruption, error) {
+	switch c := Corruption(s); c {
+	case CorruptionFlip, CorruptionTruncate:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown corruption %q", s)
+	}
+}
+
+// chance returns true with the percentage of probability.
+func (p *params) chance(percent float64) bool {
+	return percent > 0 && p.rand.Float64()*100 < percent
+}
+
+// dropped returns true if the next echo must be dropped.
+func (p *params) dropped() bool {
+	return p.chance(p.drop)
+}
+
+// buffered returns true if messages must be read as a whole to inject the
+// faults.
+func (p *params) buffered() bool {
+	return p.corrupt > 0 || p.repeat > 1 || len(p.transforms) > 0
+}
+
+// echoes returns the number of echoes of each message.
+func (p *params) echoes() int {
+	return max(p.repeat, 1)
+}
+
+// corrupted returns the payload corrupted in place if the next echo must be
+// corrupted, or the payload unchanged otherwise.
+func (p *params) corrupted(payload []byte) ([]byte, bool) {
+	if len(payload) == 0 || !p.chance(p.corrupt) {
+		return payload, false
+	}
+	switch p.corruption {
+	case CorruptionTruncate:
+		return payload[:p.rand.Intn(len(payload))], true
+	default:
+		i := p.rand.Intn(len(payload) * 8)
+		payload[i/8] ^= 1 << (i % 8)
+		return payload, true
+	}
+}
+
+// echoDelay returns the delay of the next echo.
+func (p *params) echoDelay() time.Duration {
+	if p.jitter <= 0 {
+		return p.delay
+	}
+	var d time.Duration
+	switch p.distribution {
+	case DistributionNormal:
+		d = p.delay + time.Duration(p.rand.NormFloat64()*float64(p.jitter))
+	default:
+		d = p.delay + time.Duration((2*p.rand.Float64()-1)*float64(p.jitter))
+	}
+	return max(d, 0)
+}
+
+// wait waits for the delay of the next echo, returning false if the context
+// is done first.
+func (p *params) wait(ctx context.Context) bool {
+	return sleep(ctx, p.echoDelay())
+}
+
+// sleep waits for the duration, returning false if the context is done
+// first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,102 @@
+package wsecho
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// WithTrustedProxies takes the address of the client from the Forwarded or
+// X-Forwarded-For header of requests sent by proxies in the prefixes, so it
+// is the one logged and checked by WithAllowedCIDRs. Addresses are read from
+// the right of the header, skipping the trusted ones, so clients can't spoof
+// theirs by sending the header themselves. Forwarded takes precedence over
+// X-Forwarded-For.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.trustedProxies = prefixes
+	}
+}
+
+// forwarded returns the request with the address of the client as remote
+// address if it was sent by a trusted proxy.
+func (s *Server) forwarded(r *http.Request) *http.Request {
+	if len(s.trustedProxies) == 0 {
+		return r
+	}
+	addr, ok := remoteAddr(r)
+	if !ok || !s.trustedProxy(addr) {
+		return r
+	}
+	client := ""
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// Obfuscated or unknown hops can't be trusted further.
+			break
+		}
+		client = hops[i]
+		if !s.trustedProxy(addr) {
+			break
+		}
+	}
+	if client == "" {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	r.RemoteAddr = strings.Trim(client, "[]")
+	if ap, err := netip.ParseAddrPort(client); err == nil {
+		r.RemoteAddr = ap.String()
+	}
+	return r
+}
+
+// trustedProxy returns true if the address is one of a trusted proxy.
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses of the hops in the Forwarded header,
+// or in the X-Forwarded-For header if it is missing, from left to right.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				hop := "unknown"
+				for _, pair := range strings.Split(elem, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hop = strings.Trim(v, `"`)
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop parses the address of a hop, with or without port.
+func parseHop(hop string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,193 @@
+package wsecho
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// WithFragments echoes each frame as soon as it arrives, preserving the
+// fragmentation of messages instead of reassembling them, to test how
+// clients handle continuation frames. Connections are served with gobwas/ws
+// in this mode and messages aren't inspected, so capture, HMAC, UTF-8
+// validation, keepalive and compression aren't supported.
+func WithFragments(enabled bool) Option {
+	return func(s *Server) {
+		s.fragments = enabled
+	}
+}
+
+// frames tracks the message being received frame by frame.
+type frames struct {
+	size       int64
+	fragmented bool
+	stats      *connStats
+}
+
+// serveFragments upgrades the connection and echoes each frame until the
+// connection ends.
+func (s *Server) serveFragments(w http.ResponseWriter, r *http.Request, id uint64, start time.Time,
+	claims jwt.MapClaims, logger *slog.Logger) {
+	conn, rw, subprotocol, ok := s.hijack(w, r, id, start, logger)
+	if !ok {
+		return
+	}
+	var connErr error
+	defer func() {
+		s.accessLog.log(r, id, start, subprotocol, true, connErr)
+	}()
+	s.metrics.connOpened()
+	defer s.metrics.connClosed()
+	s.vars.connOpened()
+	defer s.vars.connClosed()
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logger.Error("couldn't close", "error", err)
+		}
+	}()
+	lc := &lockedConn{Conn: conn}
+
+	tc := &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		uri:        r.URL.Path,
+		proto:      r.Proto,
+		start:      start,
+		goAway: func() {
+			logger.Info("going away")
+			go writeClose(lc, ws.StatusGoingAway, errShuttingDown.Error())
+		},
+		kill: func() {
+			_ = conn.Close()
+		},
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			go writeClose(lc, ws.StatusCode(code), reason)
+		},
+	}
+	defer s.tracker.add(tc)()
+
+	if subprotocol != "" {
+		logger.Info("subprotocol negotiated", "subprotocol", subprotocol)
+	}
+
+	// Describe the upgrade request to the client.
+	info, err := s.handshakeMessage(r, subprotocol)
+	if err != nil {
+		logger.Error("couldn't encode handshake info", "error", err)
+		return
+	}
+	if info != nil {
+		if err := lc.writeFrames(func(w io.Writer) error {
+			return wsutil.WriteServerText(w, info)
+		}); err != nil {
+			logger.Error("couldn't write handshake info", "error", err)
+			return
+		}
+	}
+
+	// Send the selected token claims back to the client.
+	if claims != nil {
+		greeting, err := s.jwt.greeting(claims)
+		if err != nil {
+			logger.Error("couldn't encode claims", "error", err)
+			return
+		}
+		if greeting != nil {
+			if err := lc.writeFrames(func(w io.Writer) error {
+				return wsutil.WriteServerText(w, greeting)
+			}); err != nil {
+				logger.Error("couldn't write claims", "error", err)
+				return
+			}
+		}
+	}
+
+	f := frames{stats: &tc.stats}
+	for {
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return
+			}
+		}
+		if err := s.echoFrame(lc, rw.Reader, &f); err != nil {
+			connErr = s.hijackedError(logger, err)
+			return
+		}
+	}
+}
+
+// echoFrame reads the next frame from src and echoes it to conn with the
+// same opcode and fin bit. Control frames are answered instead. The write
+// lock of the connection is held while the frame is echoed, since its
+// payload is written as it is read.
+func (s *Server) echoFrame(conn *lockedConn, src io.Reader, f *frames) error {
+	hdr, err := ws.ReadHeader(src)
+	if err != nil {
+		return err
+	}
+	state := ws.StateServerSide
+	if f.fragmented {
+		state |= ws.StateFragmented
+	}
+	if err := ws.CheckHeader(hdr, state); err != nil {
+		writeClose(conn, ws.StatusProtocolError, "")
+		return err
+	}
+	if hdr.OpCode.IsControl() {
+		return controlHandler(conn, false)(hdr, io.LimitReader(src, hdr.Length))
+	}
+	if hdr.OpCode != ws.OpContinuation {
+		f.size = 0
+	}
+	f.size += hdr.Length
+	f.fragmented = !hdr.Fin
+	if s.maxMessageSize > 0 && f.size > s.maxMessageSize {
+		writeClose(conn, ws.StatusMessageTooBig, "")
+		return errMessageTooBig
+	}
+
+	echoStart := time.Now()
+	if s.writeTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	if err := conn.writeFrames(func(w io.Writer) error {
+		if err := ws.WriteHeader(w, ws.Header{Fin: hdr.Fin, OpCode: hdr.OpCode, Length: hdr.Length}); err != nil {
+			return fmt.Errorf("couldn't write: %w", err)
+		}
+		buf := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(buf)
+		for offset := int64(0); offset < hdr.Length; {
+			p := (*buf)[:min(int64(len(*buf)), hdr.Length-offset)]
+			if _, err := io.ReadFull(src, p); err != nil {
+				return err
+			}
+			if hdr.Masked {
+				ws.Cipher(p, hdr.Mask, int(offset))
+			}
+			if _, err := w.Write(p); err != nil {
+				return fmt.Errorf("couldn't write: %w", err)
+			}
+			offset += int64(len(p))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if hdr.Fin {
+		s.metrics.echoed(int(f.size), time.Since(echoStart))
+		s.vars.echoed(int(f.size), time.Since(echoStart))
+		f.stats.received(int(f.size))
+		f.stats.sent(int(f.size))
+	}
+	return nil
+}
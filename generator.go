@@ -0,0 +1,109 @@
+package wsecho
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// defaultStreamSize is the default size in bytes of the messages pushed by
+// the stream handler.
+const defaultStreamSize = 4096
+
+// WithStream sets the defaults of the messages pushed to stream clients: the
+// size in bytes, the rate in messages per second, 0 for as fast as possible,
+// and the payload type. Clients can set them for their connection with the
+// size, rate and payload query parameters, and limit the number of messages
+// with the count query parameter, e.g. /stream?size=4096&rate=100.
+func WithStream(size int, msgRate float64, typ PayloadType) Option {
+	return func(s *Server) {
+		s.params.streamSize = size
+		s.params.streamRate = msgRate
+		s.params.streamPayload = typ
+	}
+}
+
+// StreamHandler returns an http.Handler serving websocket connections that
+// are pushed messages without requiring the client to send any, to measure
+// download throughput and backpressure of consumers. Text payloads are sent
+// as text messages, other payloads as binary messages. Messages received
+// from the client are discarded. The connection is closed normally once the
+// count of messages is sent.
+func (s *Server) StreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMode(w, r, modeStream)
+	})
+}
+
+// generate pushes messages to the client until the connection is closed,
+// returning the error that ended it.
+func (s *Server) generate(c *session) error {
+	conn, logger, p := c.conn, c.logger, c.params
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	// Read in the background to handle control messages.
+	readErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		for {
+			_, r, err := conn.NextReader()
+			var n int64
+			if err == nil {
+				n, err = io.Copy(io.Discard, r)
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			c.live.active()
+			c.stats.received(int(n))
+		}
+	}()
+
+	size := p.streamSize
+	if size <= 0 {
+		size = defaultStreamSize
+	}
+	gen := newPayloadGenerator(p.streamPayload, size, p.rand.Int63())
+	mt := websocket.BinaryMessage
+	if p.streamPayload == PayloadText {
+		mt = websocket.TextMessage
+	}
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if p.streamRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(p.streamRate), 1)
+	}
+	for seq := 0; p.streamCount <= 0 || seq < p.streamCount; seq++ {
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		if err := s.setWriteDeadline(conn); err != nil {
+			logger.Error("couldn't set write deadline", "error", err)
+			return err
+		}
+		payload := gen.next(seq)
+		var err error
+		if p.limiter != nil {
+			_, _, err = stream(ctx, conn, mt, bytes.NewReader(payload), p.limiter)
+		} else {
+			err = conn.WriteMessage(mt, payload)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return s.writeError(logger, err)
+		}
+		c.stats.sent(len(payload))
+	}
+	if ctx.Err() == nil {
+		logger.Info("stream done", "count", p.streamCount)
+		c.closeConn(websocket.CloseNormalClosure, "")
+	}
+	return s.readError(c.ctx, logger, <-readErr)
+}
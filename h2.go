@@ -0,0 +1,652 @@
+package wsecho
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// Websockets can be bootstrapped over HTTP/2 with extended CONNECT (RFC
+// 8441) instead of an HTTP/1.1 upgrade. The websocket libraries only speak
+// HTTP/1.1, so the streams are handed to them as hijacked connections and
+// the HTTP/1.1 handshake they write is translated to HTTP/2 headers.
+//
+// The net/http server only advertises extended CONNECT since Go 1.24, when
+// run with GODEBUG=http2xconnect=1. The setting is read by net/http from the
+// environment, it can't be set with a //go:debug directive.
+
+// websocketGUID is the GUID used to compute Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// hopHeaders are the HTTP/1.1 upgrade headers that aren't sent over HTTP/2.
+var hopHeaders = []string{"Connection", "Upgrade", "Sec-Websocket-Key", "Sec-Websocket-Accept"}
+
+// extendedConnectEnabled returns true if the net/http server advertises
+// extended CONNECT.
+func extendedConnectEnabled() bool {
+	return strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1")
+}
+
+// isExtendedConnect returns true if the request bootstraps a websocket with
+// extended CONNECT.
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
+// extendedConnect returns the response writer and request to upgrade a
+// websocket bootstrapped with extended CONNECT as an HTTP/1.1 upgrade, or
+// the ones provided for other requests.
+func extendedConnect(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if !isExtendedConnect(r) {
+		return w, r
+	}
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	up := r.WithContext(r.Context())
+	up.Method = http.MethodGet
+	up.Proto, up.ProtoMajor, up.ProtoMinor = "HTTP/1.1", 1, 1
+	up.Header = r.Header.Clone()
+	up.Header.Del(":protocol")
+	up.Header.Set("Connection", "Upgrade")
+	up.Header.Set("Upgrade", "websocket")
+	up.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	return &h2Writer{ResponseWriter: w, conn: newH2Conn(w, r)}, up
+}
+
+// h2Writer hands the stream of an extended CONNECT over as a hijacked
+// connection.
+type h2Writer struct {
+	http.ResponseWriter
+	conn *h2Conn
+}
+
+func (w *h2Writer) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols {
+		_ = w.conn.accept()
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *h2Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// h2Conn is the stream of an extended CONNECT served as a connection. The
+// HTTP/1.1 upgrade response written by the library is sent as the HTTP/2
+// response headers.
+type h2Conn struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	body   io.ReadCloser
+	remote net.Addr
+	local  net.Addr
+
+	mu       sync.Mutex
+	accepted bool
+	closed   bool
+}
+
+func newH2Conn(w http.ResponseWriter, r *http.Request) *h2Conn {
+	c := &h2Conn{
+		w:      w,
+		rc:     http.NewResponseController(w),
+		body:   r.Body,
+		remote: h2Addr(r.RemoteAddr),
+		local:  h2Addr(""),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+	return c
+}
+
+// accept sends the response headers accepting the websocket.
+func (c *h2Conn) accept() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accepted {
+		return nil
+	}
+	c.accepted = true
+	for _, k := range hopHeaders {
+		c.w.Header().Del(k)
+	}
+	c.w.WriteHeader(http.StatusOK)
+	return c.rc.Flush()
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, accepted := c.closed, c.accepted
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	n := 0
+	if !accepted {
+		// The library wrote the upgrade response on the connection.
+		end := bytes.Index(b, []byte("\r\n\r\n"))
+		if end < 0 {
+			return 0, errors.New("partial upgrade response")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:end+4])), nil)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't parse upgrade response: %w", err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return 0, fmt.Errorf("unexpected upgrade response %s", resp.Status)
+		}
+		for k, v := range resp.Header {
+			c.w.Header()[k] = v
+		}
+		if err := c.accept(); err != nil {
+			return 0, err
+		}
+		n, b = end+4, b[end+4:]
+		if len(b) == 0 {
+			return n, nil
+		}
+	}
+	m, err := c.w.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n + m, err
+}
+
+func (c *h2Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	// The stream ends once the handler returns.
+	return c.body.Close()
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return c.local }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *h2Conn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// h2Addr is the address of the peer of a stream.
+type h2Addr string
+
+func (a h2Addr) Network() string { return "tcp" }
+func (a h2Addr) String() string  { return string(a) }
+
+// WithHTTP2 bootstraps the connections with extended CONNECT over HTTP/2
+// (RFC 8441) instead of an HTTP/1.1 upgrade, each on its own TLS
+// connection. It requires wss hosts and a server advertising extended
+// CONNECT, and can't be used with proxies.
+func WithHTTP2(enabled bool) PingOption {
+	return func(c *pingConfig) {
+		c.http2 = enabled
+	}
+}
+
+const (
+	// settingEnableConnectProtocol is the setting advertising extended
+	// CONNECT.
+	settingEnableConnectProtocol http2.SettingID = 0x8
+	// h2Stream is the id of the stream of a client connection.
+	h2Stream = 1
+	// h2InitialWindow is the initial flow control window of HTTP/2.
+	h2InitialWindow = 65535
+	// h2MaxFrame is the maximum DATA frame size sent.
+	h2MaxFrame = 16384
+)
+
+// h2Dialer returns a dial function for gorilla/websocket dialers opening a
+// TLS connection negotiating HTTP/2 with ALPN for each websocket.
+func h2Dialer(netDialer *net.Dialer, tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		cfg.NextProtos = []string{"h2"}
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ServerName = host
+		}
+		d := &tls.Dialer{NetDialer: netDialer, Config: cfg}
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if p := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != "h2" {
+			_ = conn.Close()
+			return nil, fmt.Errorf("server doesn't support HTTP/2, negotiated %q", p)
+		}
+		return newH2ClientConn(conn, addr), nil
+	}
+}
+
+// h2ClientConn is a websocket bootstrapped with extended CONNECT on its own
+// HTTP/2 connection. The HTTP/1.1 upgrade request written by the library
+// is sent as an HTTP/2 request, and the response is read back as an
+// HTTP/1.1 upgrade response.
+type h2ClientConn struct {
+	conn   net.Conn
+	addr   string
+	framer *http2.Framer
+	// wmu serializes the writes of frames.
+	wmu sync.Mutex
+
+	handshake bytes.Buffer
+	opened    bool
+	response  bytes.Reader
+
+	readDeadline  streamDeadline
+	writeDeadline streamDeadline
+
+	// mu guards the fields below, updated by the frames read in the
+	// background, and cond is signalled when they change.
+	mu           sync.Mutex
+	cond         *sync.Cond
+	settings     bool
+	connect      bool
+	status       string
+	header       http.Header
+	data         bytes.Buffer
+	connWindow   int64
+	streamWindow int64
+	err          error
+	closed       bool
+}
+
+func newH2ClientConn(conn net.Conn, addr string) *h2ClientConn {
+	c := &h2ClientConn{
+		conn:         conn,
+		addr:         addr,
+		framer:       http2.NewFramer(conn, bufio.NewReader(conn)),
+		connWindow:   h2InitialWindow,
+		streamWindow: h2InitialWindow,
+	}
+	c.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *h2ClientConn) Write(b []byte) (int, error) {
+	if !c.opened {
+		// Buffer the upgrade request until it is complete.
+		c.handshake.Write(b)
+		if !bytes.Contains(c.handshake.Bytes(), []byte("\r\n\r\n")) {
+			return len(b), nil
+		}
+		if err := c.open(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n := 0
+	for len(b) > 0 {
+		c.mu.Lock()
+		err := c.wait(&c.writeDeadline, func() bool {
+			return c.connWindow > 0 && c.streamWindow > 0
+		})
+		if err != nil {
+			c.mu.Unlock()
+			return n, err
+		}
+		size := min(int64(len(b)), c.connWindow, c.streamWindow, h2MaxFrame)
+		c.connWindow -= size
+		c.streamWindow -= size
+		c.mu.Unlock()
+
+		c.wmu.Lock()
+		err = c.framer.WriteData(h2Stream, false, b[:size])
+		c.wmu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// open starts the HTTP/2 connection and sends the extended CONNECT request
+// translated from the upgrade request.
+func (c *h2ClientConn) open() error {
+	up, err := http.ReadRequest(bufio.NewReader(&c.handshake))
+	if err != nil {
+		return fmt.Errorf("couldn't parse upgrade request: %w", err)
+	}
+
+	c.wmu.Lock()
+	_, err = io.WriteString(c.conn, http2.ClientPreface)
+	if err == nil {
+		err = c.framer.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0})
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("couldn't start http2: %w", err)
+	}
+	go c.readFrames()
+
+	// Extended CONNECT can only be sent once the server advertises it.
+	c.mu.Lock()
+	err = c.wait(&c.readDeadline, func() bool { return c.settings })
+	connect := c.connect
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("couldn't read http2 settings: %w", err)
+	}
+	if !connect {
+		return errors.New("server doesn't support extended connect")
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodConnect},
+		{Name: ":protocol", Value: "websocket"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: up.Host},
+		{Name: ":path", Value: up.URL.RequestURI()},
+	}
+	for k, vs := range up.Header {
+		if slices.Contains(hopHeaders, k) {
+			continue
+		}
+		for _, v := range vs {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	for _, f := range fields {
+		if err := enc.WriteField(f); err != nil {
+			return err
+		}
+	}
+	if block.Len() > h2MaxFrame {
+		return errors.New("upgrade headers too large")
+	}
+	c.wmu.Lock()
+	err = c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2Stream,
+		BlockFragment: block.Bytes(),
+		EndHeaders:    true,
+	})
+	c.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("couldn't send extended connect: %w", err)
+	}
+
+	c.mu.Lock()
+	err = c.wait(&c.readDeadline, func() bool { return c.status != "" })
+	status, header := c.status, c.header
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("couldn't read extended connect response: %w", err)
+	}
+
+	// Reply to the library as if the server upgraded the connection.
+	var b bytes.Buffer
+	if status == "200" {
+		h := sha1.Sum([]byte(up.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", "websocket")
+		header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(h[:]))
+		b.WriteString("HTTP/2.0 101 Switching Protocols\r\n")
+	} else {
+		fmt.Fprintf(&b, "HTTP/2.0 %s %s\r\n", status, http.StatusText(atoi(status)))
+	}
+	_ = header.Write(&b)
+	b.WriteString("\r\n")
+	c.response.Reset(b.Bytes())
+	c.opened = true
+	return nil
+}
+
+// readFrames reads the frames of the connection until it fails.
+func (c *h2ClientConn) readFrames() {
+	err := c.handleFrames()
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *h2ClientConn) handleFrames() error {
+	for {
+		f, err := c.framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				break
+			}
+			_ = f.ForeachSetting(func(s http2.Setting) error {
+				switch s.ID {
+				case settingEnableConnectProtocol:
+					c.connect = s.Val == 1
+				case http2.SettingInitialWindowSize:
+					c.streamWindow += int64(s.Val) - h2InitialWindow
+				}
+				return nil
+			})
+			c.settings = true
+			c.write(func() error { return c.framer.WriteSettingsAck() })
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != h2Stream || c.status != "" {
+				break
+			}
+			c.status = f.PseudoValue("status")
+			c.header = http.Header{}
+			for _, hf := range f.RegularFields() {
+				c.header.Add(hf.Name, hf.Value)
+			}
+			if f.StreamEnded() {
+				c.err = io.EOF
+			}
+		case *http2.DataFrame:
+			c.data.Write(f.Data())
+			if f.StreamEnded() {
+				c.err = io.EOF
+			}
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 {
+				c.connWindow += int64(f.Increment)
+			} else {
+				c.streamWindow += int64(f.Increment)
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				c.write(func() error { return c.framer.WritePing(true, f.Data) })
+			}
+		case *http2.RSTStreamFrame:
+			c.err = fmt.Errorf("stream reset: %v", f.ErrCode)
+		case *http2.GoAwayFrame:
+			if f.LastStreamID < h2Stream {
+				c.err = fmt.Errorf("connection going away: %v", f.ErrCode)
+			}
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// write writes a frame in the background, so the frames read aren't
+// blocked by the writes.
+func (c *h2ClientConn) write(fn func() error) {
+	go func() {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		_ = fn()
+	}()
+}
+
+// wait waits, with mu held, until done returns true, the stream ends or the
+// deadline passes.
+func (c *h2ClientConn) wait(d *streamDeadline, done func() bool) error {
+	for !done() {
+		switch {
+		case c.closed:
+			return net.ErrClosed
+		case c.err != nil:
+			return c.err
+		case d.expired():
+			return os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
+
+func (c *h2ClientConn) Read(b []byte) (int, error) {
+	if c.response.Len() > 0 {
+		return c.response.Read(b)
+	}
+	c.mu.Lock()
+	if err := c.wait(&c.readDeadline, func() bool { return c.data.Len() > 0 }); err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	n, _ := c.data.Read(b)
+	c.mu.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
+
+	// Let the server send as much as it was read.
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.framer.WriteWindowUpdate(0, uint32(n)); err != nil {
+		return n, err
+	}
+	if err := c.framer.WriteWindowUpdate(h2Stream, uint32(n)); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (c *h2ClientConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.readDeadline.set(time.Time{}, nil)
+	c.writeDeadline.set(time.Time{}, nil)
+
+	// End the stream before closing the connection.
+	c.wmu.Lock()
+	_ = c.framer.WriteData(h2Stream, true, nil)
+	c.wmu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *h2ClientConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *h2ClientConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *h2ClientConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Frames are read in the background, so the read deadline applies to the
+// data waited for instead of the connection.
+func (c *h2ClientConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t, c.broadcast)
+	return nil
+}
+
+func (c *h2ClientConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t, c.broadcast)
+	return c.conn.SetWriteDeadline(t)
+}
+
+// broadcast wakes up the reads and writes waiting.
+func (c *h2ClientConn) broadcast() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// streamDeadline calls a function once its deadline passes.
+type streamDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	passed bool
+}
+
+// set sets the deadline, zero for none, replacing the previous one.
+func (d *streamDeadline) set(t time.Time, passed func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.passed = false
+	if t.IsZero() {
+		return
+	}
+	d.timer = time.AfterFunc(time.Until(t), func() {
+		d.mu.Lock()
+		d.passed = true
+		d.mu.Unlock()
+		passed()
+	})
+}
+
+// expired returns true if the deadline passed.
+func (d *streamDeadline) expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passed
+}
+
+// atoi returns the integer of s, or zero.
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,97 @@
+package wsecho
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+)
+
+// HandshakeInfo describes the upgrade request as it reached the server.
+type HandshakeInfo struct {
+	// RemoteAddr is the address of the client, or of the last proxy.
+	RemoteAddr string `json:"remote_addr"`
+	// Method is the HTTP method of the request.
+	Method string `json:"method"`
+	// Host is the host requested.
+	Host string `json:"host"`
+	// URI is the request URI.
+	URI string `json:"uri"`
+	// Proto is the HTTP protocol version.
+	Proto string `json:"proto"`
+	// Header contains the request headers. The values of the headers
+	// carrying credentials are redacted.
+	Header http.Header `json:"header"`
+	// Subprotocol is the negotiated subprotocol.
+	Subprotocol string `json:"subprotocol,omitempty"`
+	// TLS describes the TLS connection, nil for plain connections.
+	TLS *HandshakeTLS `json:"tls,omitempty"`
+}
+
+// HandshakeTLS describes the TLS connection of the upgrade request.
+type HandshakeTLS struct {
+	// Version is the TLS version, e.g. TLS 1.3.
+	Version string `json:"version"`
+	// CipherSuite is the name of the cipher suite.
+	CipherSuite string `json:"cipher_suite"`
+	// ServerName is the server name sent by the client with SNI.
+	ServerName string `json:"server_name,omitempty"`
+	// NegotiatedProtocol is the protocol negotiated with ALPN.
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+	// PeerCertificates are the subjects of the client certificates.
+	PeerCertificates []string `json:"peer_certificates,omitempty"`
+}
+
+// credentialHeaders are the headers whose values are redacted from the
+// handshake info, so credentials added by proxies aren't disclosed.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// WithHandshakeInfo sends a HandshakeInfo as a JSON text message to each
+// client after the upgrade, before any other message, to debug what reaches
+// the server through proxies.
+func WithHandshakeInfo(enabled bool) Option {
+	return func(s *Server) {
+		s.handshakeInfo = enabled
+	}
+}
+
+// handshakeMessage returns the JSON message describing the upgrade request,
+// or nil if it is disabled.
+func (s *Server) handshakeMessage(r *http.Request, subprotocol string) ([]byte, error) {
+	if !s.handshakeInfo {
+		return nil, nil
+	}
+	info := HandshakeInfo{
+		RemoteAddr:  r.RemoteAddr,
+		Method:      r.Method,
+		Host:        r.Host,
+		URI:         r.RequestURI,
+		Proto:       r.Proto,
+		Header:      redactHeader(r.Header),
+		Subprotocol: subprotocol,
+	}
+	if r.TLS != nil {
+		t := &HandshakeTLS{
+			Version:            tls.VersionName(r.TLS.Version),
+			CipherSuite:        tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:         r.TLS.ServerName,
+			NegotiatedProtocol: r.TLS.NegotiatedProtocol,
+		}
+		for _, cert := range r.TLS.PeerCertificates {
+			t.PeerCertificates = append(t.PeerCertificates, cert.Subject.String())
+		}
+		info.TLS = t
+	}
+	return json.Marshal(info)
+}
+
+// redactHeader returns a copy of the header with the values of the
+// credential headers redacted.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range credentialHeaders {
+		for i := range h[name] {
+			h[name][i] = "REDACTED"
+		}
+	}
+	return h
+}
@@ -0,0 +1,121 @@
+package wsecho
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// WithVersion sets the version reported by HealthHandler.
+func WithVersion(v string) Option {
+	return func(s *Server) {
+		s.version = v
+	}
+}
+
+// Health describes the health of a server.
+// Durations are encoded to JSON as nanoseconds.
+type Health struct {
+	// Status is ok, or the reason the server isn't ready.
+	Status string `json:"status"`
+	// Ready is true if the server accepts upgrades.
+	Ready bool `json:"ready"`
+	// Version is the version set by WithVersion.
+	Version string `json:"version,omitempty"`
+	// Started is the time the server started.
+	Started time.Time `json:"started"`
+	// Uptime is the time since the server started.
+	Uptime time.Duration `json:"uptime"`
+	// ActiveConnections is the number of live connections.
+	ActiveConnections int `json:"active_connections"`
+	// Runtime contains Go runtime statistics of the process.
+	Runtime HealthRuntime `json:"runtime"`
+}
+
+// HealthRuntime contains Go runtime statistics.
+type HealthRuntime struct {
+	// Version is the Go version the binary was built with.
+	Version string `json:"version"`
+	// Goroutines is the number of goroutines.
+	Goroutines int `json:"goroutines"`
+	// CPUs is the number of logical CPUs usable by the process.
+	CPUs int `json:"cpus"`
+	// HeapAlloc is the number of bytes of allocated heap objects.
+	HeapAlloc uint64 `json:"heap_alloc"`
+	// Sys is the number of bytes obtained from the OS.
+	Sys uint64 `json:"sys"`
+	// NumGC is the number of completed GC cycles.
+	NumGC uint32 `json:"num_gc"`
+	// GCPauseTotal is the total time the GC stopped the world.
+	GCPauseTotal time.Duration `json:"gc_pause_total"`
+}
+
+// Ready returns true if the server accepts upgrades, false once it is
+// draining or shutting down.
+func (s *Server) Ready() bool {
+	return s.tracker.refused() == nil
+}
+
+// Health returns the health of the server.
+func (s *Server) Health() Health {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	h := Health{
+		Status:            "ok",
+		Ready:             true,
+		Version:           s.version,
+		Started:           s.started,
+		Uptime:            time.Since(s.started),
+		ActiveConnections: len(s.tracker.live()),
+		Runtime: HealthRuntime{
+			Version:      runtime.Version(),
+			Goroutines:   runtime.NumGoroutine(),
+			CPUs:         runtime.NumCPU(),
+			HeapAlloc:    mem.HeapAlloc,
+			Sys:          mem.Sys,
+			NumGC:        mem.NumGC,
+			GCPauseTotal: time.Duration(mem.PauseTotalNs),
+		},
+	}
+	if err := s.tracker.refused(); err != nil {
+		h.Status = err.Error()
+		h.Ready = false
+	}
+	return h
+}
+
+// HealthHandler returns an http.Handler replying ok while the server can
+// serve requests, or the Health of the server in JSON format if it is
+// requested with the format=json query parameter or the Accept header.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, s.Health())
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// LivenessHandler returns an http.Handler reporting the server is alive as
+// long as it can serve requests, to be used as a liveness probe.
+func (s *Server) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// ReadinessHandler returns an http.Handler reporting whether the server
+// accepts upgrades, to be used as a readiness probe. It fails with 503
+// (service unavailable) while the server is draining or shutting down, so
+// load balancers stop sending new clients to it.
+func (s *Server) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.tracker.refused(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
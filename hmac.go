@@ -0,0 +1,59 @@
+package wsecho
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// errInvalidSignature is returned when a message signature doesn't match.
+var errInvalidSignature = errors.New("invalid signature")
+
+// Labels bind signatures to the direction of the message, so the server
+// can't echo back the client signature unchanged.
+const (
+	hmacRequest = "wsecho-request"
+	hmacEcho    = "wsecho-echo"
+)
+
+// sign appends the HMAC-SHA256 of the payload to it. The signature is hex
+// encoded in text messages to keep them valid UTF-8.
+func sign(key []byte, label string, messageType int, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(payload)
+	sum := mac.Sum(nil)
+	signed := make([]byte, 0, len(payload)+2*len(sum))
+	signed = append(signed, payload...)
+	if messageType == websocket.TextMessage {
+		return append(signed, hex.EncodeToString(sum)...)
+	}
+	return append(signed, sum...)
+}
+
+// verify checks the signature appended to data by sign and returns the
+// payload without it.
+func verify(key []byte, label string, messageType int, data []byte) ([]byte, bool) {
+	size := sha256.Size
+	if messageType == websocket.TextMessage {
+		size = hex.EncodedLen(size)
+	}
+	if len(data) < size {
+		return nil, false
+	}
+	payload, sig := data[:len(data)-size], data[len(data)-size:]
+	if messageType == websocket.TextMessage {
+		decoded := make([]byte, sha256.Size)
+		if _, err := hex.Decode(decoded, sig); err != nil {
+			return nil, false
+		}
+		sig = decoded
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(payload)
+	return payload, hmac.Equal(sig, mac.Sum(nil))
+}
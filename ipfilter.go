@@ -0,0 +1,96 @@
+package wsecho
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// errForbidden is returned when the client address isn't allowed.
+var errForbidden = errors.New("forbidden")
+
+// WithAllowedCIDRs only accepts connections from addresses in the
+// prefixes. All addresses are allowed if none are provided.
+func WithAllowedCIDRs(prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.allowed = prefixes
+	}
+}
+
+// WithDeniedCIDRs refuses connections from addresses in the prefixes,
+// taking precedence over WithAllowedCIDRs.
+func WithDeniedCIDRs(prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.denied = prefixes
+	}
+}
+
+// ParseCIDRs parses a list of CIDR prefixes. Single addresses are parsed as
+// prefixes containing only that address.
+func ParseCIDRs(cidrs ...string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(c)
+			if addrErr != nil {
+				return nil, err
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// checkAddr returns an error if the remote address of the request isn't
+// allowed to connect.
+func (s *Server) checkAddr(r *http.Request) error {
+	return s.checkRemoteAddr(r.RemoteAddr)
+}
+
+// checkRemoteAddr returns an error if the remote address, host and port,
+// isn't allowed to connect.
+func (s *Server) checkRemoteAddr(remote string) error {
+	if len(s.allowed) == 0 && len(s.denied) == 0 {
+		return nil
+	}
+	addr, ok := parseRemoteAddr(remote)
+	if !ok {
+		return errForbidden
+	}
+	for _, p := range s.denied {
+		if p.Contains(addr) {
+			return errForbidden
+		}
+	}
+	if len(s.allowed) == 0 {
+		return nil
+	}
+	for _, p := range s.allowed {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return errForbidden
+}
+
+// remoteAddr returns the IP address of the client.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	return parseRemoteAddr(r.RemoteAddr)
+}
+
+// parseRemoteAddr returns the IP address of a remote address, with or
+// without port.
+func parseRemoteAddr(remote string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,209 @@
+package wsecho
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// JWTConfig configures the validation of JSON web tokens on the upgrade
+// request.
+type JWTConfig struct {
+	// Secret validates HS256 tokens.
+	Secret []byte
+	// PublicKey validates RS256 tokens.
+	PublicKey *rsa.PublicKey
+	// JWKSURL is fetched to obtain the keys validating RS256 tokens by
+	// their kid header.
+	JWKSURL string
+	// Issuer is the required iss claim, if not empty.
+	Issuer string
+	// Audience is the required aud claim, if not empty.
+	Audience string
+	// Claims are sent back to the client in a first JSON text message.
+	Claims []string
+}
+
+// WithJWT requires clients to present a valid JSON web token on the upgrade
+// request, either as a bearer token in the Authorization header or in the
+// token query parameter. Unauthorized requests are rejected with 401.
+func WithJWT(cfg JWTConfig) Option {
+	return func(s *Server) {
+		v := &jwtValidator{cfg: cfg}
+		if cfg.JWKSURL != "" {
+			v.jwks = &jwks{url: cfg.JWKSURL}
+		}
+		s.jwt = v
+	}
+}
+
+// jwtValidator validates JSON web tokens.
+type jwtValidator struct {
+	cfg  JWTConfig
+	jwks *jwks
+}
+
+func (v *jwtValidator) validate(token string) (jwt.MapClaims, error) {
+	var methods []string
+	if v.cfg.Secret != nil {
+		methods = append(methods, "HS256")
+	}
+	if v.cfg.PublicKey != nil || v.jwks != nil {
+		methods = append(methods, "RS256")
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods)}
+	if v.cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.cfg.Issuer))
+	}
+	if v.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(v.cfg.Audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, v.key, opts...); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// key returns the key to verify the token.
+func (v *jwtValidator) key(t *jwt.Token) (any, error) {
+	switch t.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return v.cfg.Secret, nil
+	case *jwt.SigningMethodRSA:
+		if kid, _ := t.Header["kid"].(string); kid != "" && v.jwks != nil {
+			return v.jwks.key(kid)
+		}
+		if v.cfg.PublicKey == nil {
+			return nil, errors.New("missing kid")
+		}
+		return v.cfg.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing method %s", t.Method.Alg())
+	}
+}
+
+// greeting returns the JSON message with the configured claims, or nil if
+// no claims are configured.
+func (v *jwtValidator) greeting(claims jwt.MapClaims) ([]byte, error) {
+	if len(v.cfg.Claims) == 0 {
+		return nil, nil
+	}
+	selected := map[string]any{}
+	for _, c := range v.cfg.Claims {
+		if value, ok := claims[c]; ok {
+			selected[c] = value
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// jwksRefresh is the minimum time between fetches of the key set.
+const jwksRefresh = time.Minute
+
+// jwks is a JSON web key set fetched from a URL and refreshed when a token
+// uses an unknown key.
+type jwks struct {
+	url string
+	// fetches shares the fetch of the key set between the tokens waiting
+	// for it.
+	fetches singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// key returns the key with the id, fetching the key set again if it is
+// unknown. The keys already fetched keep being served while it is fetched.
+func (k *jwks) key(kid string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	key, ok := k.keys[kid]
+	recent := time.Since(k.fetched) < jwksRefresh
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if recent {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if _, err, _ := k.fetches.Do("", func() (any, error) {
+		k.mu.Lock()
+		// The key set may have been fetched since the lookup.
+		if time.Since(k.fetched) < jwksRefresh {
+			k.mu.Unlock()
+			return nil, nil
+		}
+		k.fetched = time.Now()
+		k.mu.Unlock()
+		keys, err := fetchJWKS(k.url)
+		if err != nil {
+			return nil, err
+		}
+		k.mu.Lock()
+		k.keys = keys
+		k.mu.Unlock()
+		return nil, nil
+	}); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	key, ok = k.keys[kid]
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// fetchJWKS fetches the RSA keys of a JSON web key set.
+func fetchJWKS(url string) (map[string]*rsa.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't fetch jwks: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("couldn't decode jwks: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode jwks modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode jwks exponent: %w", err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
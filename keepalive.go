@@ -0,0 +1,88 @@
+package wsecho
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WithKeepalive sends a ping to each client every interval and closes the
+// connection once maxMissed pings in a row aren't answered with a pong.
+func WithKeepalive(interval time.Duration, maxMissed int) Option {
+	return func(s *Server) {
+		s.keepaliveInterval = interval
+		s.keepaliveMaxMissed = maxMissed
+	}
+}
+
+// WithIdleTimeout closes connections that don't send any message for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// liveness tracks the activity of a connection.
+type liveness struct {
+	missed       atomic.Int32
+	lastActivity atomic.Int64
+}
+
+func (l *liveness) pong() {
+	l.missed.Store(0)
+}
+
+func (l *liveness) active() {
+	l.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (l *liveness) idle() time.Duration {
+	return time.Since(time.Unix(0, l.lastActivity.Load()))
+}
+
+// keepalive pings the client and closes the connection when it misses too
+// many pongs or stays idle for too long, until the context is done.
+func (s *Server) keepalive(ctx context.Context, conn wsConn, l *liveness, logger *slog.Logger,
+	closeConn func(code int, text string)) {
+	var ping <-chan time.Time
+	if s.keepaliveInterval > 0 {
+		ticker := time.NewTicker(s.keepaliveInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if s.idleTimeout > 0 {
+		idleTimer = time.NewTimer(s.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping:
+			if s.keepaliveMaxMissed > 0 && int(l.missed.Load()) >= s.keepaliveMaxMissed {
+				logger.Info("closing connection", "reason", "missed pongs", "missed", l.missed.Load())
+				closeConn(websocket.CloseGoingAway, "keepalive timeout")
+				return
+			}
+			l.missed.Add(1)
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.keepaliveInterval)); err != nil {
+				logger.Error("couldn't send ping", "error", err)
+				return
+			}
+		case <-idle:
+			if d := l.idle(); d < s.idleTimeout {
+				idleTimer.Reset(s.idleTimeout - d)
+				continue
+			}
+			logger.Info("closing connection", "reason", "idle timeout")
+			closeConn(websocket.CloseNormalClosure, "idle timeout")
+			return
+		}
+	}
+}
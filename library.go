@@ -0,0 +1,351 @@
+package wsecho
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cws "github.com/coder/websocket"
+	"github.com/gorilla/websocket"
+)
+
+// Library is a websocket library used to serve connections.
+type Library string
+
+const (
+	// LibraryGorilla serves connections with github.com/gorilla/websocket.
+	LibraryGorilla Library = "gorilla"
+	// LibraryCoder serves connections with github.com/coder/websocket,
+	// formerly nhooyr.io/websocket.
+	LibraryCoder Library = "coder"
+)
+
+// WithLibrary sets the websocket library used to serve connections, so the
+// behavior of the libraries can be compared with the same echo logic. The
+// default library is gorilla, or coder if built with the coder tag.
+// Connections served by the netpoll backend don't use it.
+func WithLibrary(l Library) Option {
+	return func(s *Server) {
+		s.library = l
+	}
+}
+
+// wsConn is a websocket connection served by one of the libraries, with the
+// methods of gorilla/websocket connections.
+type wsConn interface {
+	Subprotocol() string
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPingHandler(h func(appData string) error)
+	SetPongHandler(h func(appData string) error)
+	SetCloseHandler(h func(code int, text string) error)
+	NextReader() (int, io.Reader, error)
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+	UnderlyingConn() net.Conn
+}
+
+// upgrade upgrades the connection with the configured library, negotiating
+// the subprotocols instead of the configured ones if they are set.
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request, id uint64, subprotocols []string) (wsConn, error) {
+	w, r = extendedConnect(w, r)
+	if subprotocols == nil {
+		subprotocols = s.subprotocols
+	}
+	switch s.library {
+	case LibraryCoder:
+		// The response headers are sent with the upgrade response.
+		w.Header().Set(ConnIDHeader, strconv.FormatUint(id, 10))
+		return s.acceptCoder(w, r, subprotocols)
+	default:
+		u := s.upgrader
+		u.Subprotocols = subprotocols
+		conn, err := u.Upgrade(w, r, connIDHeader(id))
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// acceptCoder accepts the connection with coder/websocket.
+func (s *Server) acceptCoder(w http.ResponseWriter, r *http.Request, subprotocols []string) (wsConn, error) {
+	if !s.checkOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, errors.New("origin not allowed")
+	}
+	mode := cws.CompressionDisabled
+	if s.compression {
+		mode = cws.CompressionContextTakeover
+	}
+	hw := &hijackWriter{ResponseWriter: w}
+	conn, err := cws.Accept(hw, r, &cws.AcceptOptions{
+		Subprotocols: subprotocols,
+		// The origin is already checked.
+		InsecureSkipVerify: true,
+		CompressionMode:    mode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The read limit is enforced by coderConn.
+	conn.SetReadLimit(-1)
+	return &coderConn{conn: conn, netConn: hw.conn}, nil
+}
+
+// hijackWriter keeps the connection hijacked from the response writer.
+type hijackWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+	conn, rw, err := hj.Hijack()
+	w.conn = conn
+	return conn, rw, err
+}
+
+// coderConn adapts a coder/websocket connection to wsConn, reporting close
+// and read limit errors with the gorilla/websocket errors. Pings from the
+// client are answered by the library.
+type coderConn struct {
+	conn      *cws.Conn
+	netConn   net.Conn
+	readLimit int64
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	cancelRead    context.CancelFunc
+	pongHandler   func(appData string) error
+	closeHandler  func(code int, text string) error
+
+	// closed is closed once the close handshake started by WriteControl
+	// is done.
+	closed chan struct{}
+}
+
+func (c *coderConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+func (c *coderConn) UnderlyingConn() net.Conn {
+	return c.netConn
+}
+
+func (c *coderConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetReadDeadline sets the deadline of the next read. A deadline in the
+// past also interrupts the current read, unless the connection is closing
+// and the close handshake must be read.
+func (c *coderConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if !t.IsZero() && !t.After(time.Now()) && c.closed == nil && c.cancelRead != nil {
+		c.cancelRead()
+	}
+	return nil
+}
+
+func (c *coderConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// SetPingHandler is a no-op, pings are answered by the library.
+func (c *coderConn) SetPingHandler(h func(appData string) error) {}
+
+func (c *coderConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pongHandler = h
+}
+
+func (c *coderConn) SetCloseHandler(h func(code int, text string) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeHandler = h
+}
+
+func (c *coderConn) NextReader() (int, io.Reader, error) {
+	c.mu.Lock()
+	// The previous message is discarded once the next one is requested.
+	if c.cancelRead != nil {
+		c.cancelRead()
+	}
+	ctx, cancel := deadlineContext(c.readDeadline)
+	c.cancelRead = cancel
+	c.mu.Unlock()
+
+	mt, r, err := c.conn.Reader(ctx)
+	if err != nil {
+		return 0, nil, c.readError(err)
+	}
+	return int(mt), &coderReader{c: c, r: r, remaining: c.readLimit}, nil
+}
+
+func (c *coderConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	ctx, cancel := c.writeContext()
+	w, err := c.conn.Writer(ctx, cws.MessageType(messageType))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &coderWriter{WriteCloser: w, cancel: cancel}, nil
+}
+
+func (c *coderConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return c.WriteControl(messageType, data, time.Now().Add(time.Second))
+	}
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	return c.conn.Write(ctx, cws.MessageType(messageType), data)
+}
+
+// WriteControl sends a ping or starts the close handshake without waiting
+// for the client. The pong handler is called once the ping is answered
+// before the deadline.
+func (c *coderConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		go func() {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			if err := c.conn.Ping(ctx); err != nil {
+				return
+			}
+			c.mu.Lock()
+			h := c.pongHandler
+			c.mu.Unlock()
+			if h != nil {
+				_ = h("")
+			}
+		}()
+		return nil
+	case websocket.CloseMessage:
+		code, text := cws.StatusNoStatusRcvd, ""
+		if len(data) >= 2 {
+			code = cws.StatusCode(binary.BigEndian.Uint16(data))
+			text = string(data[2:])
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed != nil {
+			return nil
+		}
+		closed := make(chan struct{})
+		c.closed = closed
+		go func() {
+			defer close(closed)
+			_ = c.conn.Close(code, text)
+		}()
+		return nil
+	default:
+		return fmt.Errorf("unsupported control message type %d", messageType)
+	}
+}
+
+// Close closes the connection, waiting for the close handshake if it was
+// started.
+func (c *coderConn) Close() error {
+	c.mu.Lock()
+	closed, cancel := c.closed, c.cancelRead
+	c.mu.Unlock()
+	if cancel != nil {
+		defer cancel()
+	}
+	if closed != nil {
+		<-closed
+		return nil
+	}
+	return c.conn.CloseNow()
+}
+
+func (c *coderConn) writeContext() (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return deadlineContext(c.writeDeadline)
+}
+
+// readError converts close errors to gorilla/websocket close errors,
+// calling the close handler.
+func (c *coderConn) readError(err error) error {
+	var closeErr cws.CloseError
+	if errors.As(err, &closeErr) {
+		c.mu.Lock()
+		h := c.closeHandler
+		c.mu.Unlock()
+		if h != nil {
+			_ = h(int(closeErr.Code), closeErr.Reason)
+		}
+		return &websocket.CloseError{Code: int(closeErr.Code), Text: closeErr.Reason}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+	}
+	return err
+}
+
+// coderReader reads a message enforcing the read limit of the connection.
+type coderReader struct {
+	c         *coderConn
+	r         io.Reader
+	remaining int64
+}
+
+func (r *coderReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.c.readLimit > 0 {
+		r.remaining -= int64(n)
+		if r.remaining < 0 {
+			msg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+			_ = r.c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return n, websocket.ErrReadLimit
+		}
+	}
+	if err != nil && err != io.EOF {
+		return n, r.c.readError(err)
+	}
+	return n, err
+}
+
+// coderWriter releases the context of the writer once it is closed.
+type coderWriter struct {
+	io.WriteCloser
+	cancel context.CancelFunc
+}
+
+func (w *coderWriter) Close() error {
+	defer w.cancel()
+	return w.WriteCloser.Close()
+}
+
+// deadlineContext returns a context with the deadline, or without deadline
+// if it is zero.
+func deadlineContext(t time.Time) (context.Context, context.CancelFunc) {
+	if t.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), t)
+}
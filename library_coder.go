@@ -0,0 +1,6 @@
+//go:build coder
+
+package wsecho
+
+// defaultLibrary is the library used unless set with WithLibrary.
+const defaultLibrary = LibraryCoder
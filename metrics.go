@@ -0,0 +1,112 @@
+package wsecho
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics contains the prometheus metrics of a server.
+// All methods are no-ops on a nil receiver.
+type metrics struct {
+	registry          *prometheus.Registry
+	connections       prometheus.Counter
+	activeConnections prometheus.Gauge
+	messages          prometheus.Counter
+	bytes             prometheus.Counter
+	upgradeFailures   prometheus.Counter
+	oversizedMessages prometheus.Counter
+	echoDuration      prometheus.Histogram
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wsecho_connections_total",
+			Help: "Total number of websocket connections.",
+		}),
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "wsecho_active_connections",
+			Help: "Number of active websocket connections.",
+		}),
+		messages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wsecho_messages_total",
+			Help: "Total number of messages echoed.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wsecho_bytes_total",
+			Help: "Total number of bytes echoed.",
+		}),
+		upgradeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wsecho_upgrade_failures_total",
+			Help: "Total number of failed websocket upgrades.",
+		}),
+		oversizedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wsecho_oversized_messages_total",
+			Help: "Total number of connections closed for exceeding the maximum message size.",
+		}),
+		echoDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "wsecho_echo_duration_seconds",
+			Help:    "Time spent echoing each message back to the client.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+	}
+	m.registry.MustRegister(
+		m.connections,
+		m.activeConnections,
+		m.messages,
+		m.bytes,
+		m.upgradeFailures,
+		m.oversizedMessages,
+		m.echoDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) connOpened() {
+	if m == nil {
+		return
+	}
+	m.connections.Inc()
+	m.activeConnections.Inc()
+}
+
+func (m *metrics) connClosed() {
+	if m == nil {
+		return
+	}
+	m.activeConnections.Dec()
+}
+
+func (m *metrics) upgradeFailed() {
+	if m == nil {
+		return
+	}
+	m.upgradeFailures.Inc()
+}
+
+func (m *metrics) oversized() {
+	if m == nil {
+		return
+	}
+	m.oversizedMessages.Inc()
+}
+
+func (m *metrics) echoed(n int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.messages.Inc()
+	m.bytes.Add(float64(n))
+	m.echoDuration.Observe(d.Seconds())
+}
@@ -0,0 +1,589 @@
+package wsecho
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// errMessageTooBig is returned when a message exceeds the maximum size.
+var errMessageTooBig = errors.New("message too big")
+
+const (
+	// netpollWorkers is the maximum number of connections handled at the
+	// same time by the netpoll backend.
+	netpollWorkers = 1024
+
+	// netpollTimeout is the maximum time to write the echo of a message.
+	// Messages are read without waiting, so workers aren't held by clients
+	// sending them slowly.
+	netpollTimeout = 10 * time.Second
+)
+
+// WithNetpoll serves connections with gobwas/ws on top of epoll or kqueue
+// instead of gorilla/websocket, so idle connections don't hold a goroutine
+// or buffers and a single server can hold hundreds of thousands of them.
+// Keepalive, timeouts, compression and message tracing aren't supported by
+// this backend, and TLS connections are served by the default one.
+func WithNetpoll(enabled bool) Option {
+	return func(s *Server) {
+		s.netpollEnabled = enabled
+	}
+}
+
+// netpoll echoes messages of connections registered in a poller, handling
+// them in a goroutine only while they are ready to read.
+type netpoll struct {
+	s       *Server
+	poller  *poller
+	workers chan struct{}
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+
+	stopOnce sync.Once
+}
+
+// pollConn is a connection registered in the poller.
+type pollConn struct {
+	conn        *lockedConn
+	raw         syscall.RawConn
+	fd          int
+	id          uint64
+	remoteAddr  string
+	start       time.Time
+	subprotocol string
+	frames      frames
+
+	// in holds the data read that doesn't complete a message yet, it is
+	// nil once it is handled.
+	in []byte
+
+	// r is the upgrade request, kept only for the access log.
+	r *http.Request
+
+	// untrack stops tracking the connection for shutdown.
+	untrack func()
+	stats   *connStats
+}
+
+func newNetpoll(s *Server) (*netpoll, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	np := &netpoll{
+		s:       s,
+		poller:  p,
+		workers: make(chan struct{}, netpollWorkers),
+		conns:   map[int]*pollConn{},
+	}
+	go func() {
+		if err := p.wait(np.ready); err != nil {
+			s.logger.Error("netpoll stopped", "error", err)
+		}
+	}()
+	return np, nil
+}
+
+// serve upgrades the connection and registers it in the poller.
+func (np *netpoll) serve(w http.ResponseWriter, r *http.Request, id uint64, start time.Time,
+	claims jwt.MapClaims, logger *slog.Logger) {
+	s := np.s
+	conn, rw, subprotocol, ok := s.hijack(w, r, id, start, logger)
+	if !ok {
+		return
+	}
+	raw, fd, err := connFd(conn)
+	if err != nil {
+		_ = conn.Close()
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Error("couldn't register connection", "error", err)
+		return
+	}
+	c := &pollConn{
+		conn:        &lockedConn{Conn: conn},
+		raw:         raw,
+		fd:          fd,
+		id:          id,
+		remoteAddr:  r.RemoteAddr,
+		start:       start,
+		subprotocol: subprotocol,
+	}
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		c.in = append([]byte(nil), b...)
+	}
+	if s.accessLog != nil {
+		c.r = r
+	}
+	s.metrics.connOpened()
+	s.vars.connOpened()
+	tc := &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		uri:        r.URL.Path,
+		proto:      r.Proto,
+		start:      start,
+		goAway: func() {
+			np.logger(c).Info("going away")
+			go writeClose(c.conn, ws.StatusGoingAway, errShuttingDown.Error())
+		},
+		kill: func() {
+			np.close(c, errShuttingDown)
+		},
+		close: func(code int, reason string) {
+			np.logger(c).Info("closing on admin request", "code", code, "reason", reason)
+			go writeClose(c.conn, ws.StatusCode(code), reason)
+		},
+	}
+	c.stats = &tc.stats
+	c.frames.stats = c.stats
+	// The connection can be killed once it is published, untrack must be
+	// set before.
+	np.mu.Lock()
+	c.untrack = s.tracker.add(tc)
+	np.conns[fd] = c
+	np.mu.Unlock()
+
+	if subprotocol != "" {
+		logger.Info("subprotocol negotiated", "subprotocol", subprotocol)
+	}
+
+	// Describe the upgrade request to the client.
+	info, err := s.handshakeMessage(r, subprotocol)
+	if err != nil {
+		np.close(c, fmt.Errorf("couldn't encode handshake info: %w", err))
+		return
+	}
+	if info != nil {
+		if err := c.conn.writeFrames(func(w io.Writer) error {
+			return wsutil.WriteServerText(w, info)
+		}); err != nil {
+			np.close(c, fmt.Errorf("couldn't write handshake info: %w", err))
+			return
+		}
+	}
+
+	// Send the selected token claims back to the client.
+	if claims != nil {
+		greeting, err := s.jwt.greeting(claims)
+		if err != nil {
+			np.close(c, fmt.Errorf("couldn't encode claims: %w", err))
+			return
+		}
+		if greeting != nil {
+			if err := c.conn.writeFrames(func(w io.Writer) error {
+				return wsutil.WriteServerText(w, greeting)
+			}); err != nil {
+				np.close(c, fmt.Errorf("couldn't write claims: %w", err))
+				return
+			}
+		}
+	}
+
+	// Echo the data read ahead before waiting for the connection.
+	if c.in != nil {
+		if err := np.handle(c); err != nil {
+			np.close(c, err)
+			return
+		}
+	}
+	if err := np.poller.add(fd); err != nil {
+		np.close(c, fmt.Errorf("couldn't register connection: %w", err))
+	}
+}
+
+// ready handles the connection with the file descriptor in a worker,
+// blocking while all the workers are busy.
+func (np *netpoll) ready(fd int) {
+	np.mu.Lock()
+	c := np.conns[fd]
+	np.mu.Unlock()
+	if c == nil {
+		return
+	}
+	np.workers <- struct{}{}
+	go func() {
+		defer func() { <-np.workers }()
+		if err := np.handle(c); err != nil {
+			np.close(c, err)
+			return
+		}
+		if err := np.poller.resume(c.fd); err != nil {
+			np.close(c, fmt.Errorf("couldn't resume connection: %w", err))
+		}
+	}()
+}
+
+// handle reads the data available on the connection without waiting for
+// more, and echoes the messages it completes. The rest of the data is kept
+// until the connection is ready to read again.
+func (np *netpoll) handle(c *pollConn) error {
+	readErr := np.read(c)
+	for len(c.in) > 0 {
+		n, err := np.next(c)
+		if errors.Is(err, errMessageTooBig) {
+			writeClose(c.conn, ws.StatusMessageTooBig, "")
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if err := np.echo(c, bytes.NewReader(c.in[:n])); err != nil {
+			return err
+		}
+		c.in = c.in[n:]
+	}
+	if len(c.in) == 0 {
+		c.in = nil
+	} else if readErr == nil && cap(c.in) > 2*len(c.in) {
+		// Don't hold the data already handled.
+		c.in = append([]byte(nil), c.in...)
+	}
+	return readErr
+}
+
+// read appends the data available on the connection, up to the size of a
+// copy buffer, to the data not handled yet.
+func (np *netpoll) read(c *pollConn) error {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	b := *buf
+	var n int
+	var readErr error
+	if err := c.raw.Read(func(fd uintptr) bool {
+		n, readErr = np.poller.read(fd, b)
+		// Don't wait for the connection to be ready again.
+		return true
+	}); err != nil {
+		return err
+	}
+	switch {
+	case errors.Is(readErr, syscall.EAGAIN), errors.Is(readErr, syscall.EINTR):
+		return nil
+	case readErr != nil:
+		return readErr
+	case n == 0:
+		return io.EOF
+	}
+	c.in = append(c.in, b[:n]...)
+	return nil
+}
+
+// next returns the length of the frames at the start of the data not
+// handled yet that hold the next message, or a control frame, or 0 if
+// they aren't complete. Each frame is handled on its own in fragments mode.
+func (np *netpoll) next(c *pollConn) (int, error) {
+	s := np.s
+	var n int
+	var size int64
+	for {
+		r := bytes.NewReader(c.in[n:])
+		hdr, err := ws.ReadHeader(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !hdr.OpCode.IsControl() {
+			size += hdr.Length
+			if !s.fragments && s.maxMessageSize > 0 && size > s.maxMessageSize {
+				return 0, errMessageTooBig
+			}
+		}
+		if hdr.Length > int64(r.Len()) {
+			return 0, nil
+		}
+		first := n == 0
+		n += len(c.in[n:]) - r.Len() + int(hdr.Length)
+		switch {
+		case s.fragments, first && hdr.OpCode.IsControl(), hdr.Fin && !hdr.OpCode.IsControl():
+			return n, nil
+		}
+		// Control frames in the middle of a message are answered with it.
+	}
+}
+
+// echo reads the message, or control frame, from src and echoes it.
+func (np *netpoll) echo(c *pollConn, src io.Reader) error {
+	s := np.s
+	if err := c.conn.SetWriteDeadline(time.Now().Add(netpollTimeout)); err != nil {
+		return err
+	}
+	if s.fragments {
+		return s.echoFrame(c.conn, src, &c.frames)
+	}
+	control := controlHandler(c.conn, true)
+	rd := &wsutil.Reader{
+		Source:         src,
+		State:          ws.StateServerSide,
+		OnIntermediate: control,
+	}
+	hdr, err := rd.NextFrame()
+	if err != nil {
+		return err
+	}
+	if hdr.OpCode.IsControl() {
+		return control(hdr, rd)
+	}
+
+	var r io.Reader = rd
+	if s.maxMessageSize > 0 {
+		r = io.LimitReader(rd, s.maxMessageSize+1)
+	}
+	message, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if s.maxMessageSize > 0 && int64(len(message)) > s.maxMessageSize {
+		writeClose(c.conn, ws.StatusMessageTooBig, "")
+		return errMessageTooBig
+	}
+	c.stats.received(len(message))
+	mt := int(hdr.OpCode)
+	if s.invalidUTF8(mt, message) {
+		writeClose(c.conn, ws.StatusInvalidFramePayloadData, "invalid UTF-8")
+		return errInvalidUTF8
+	}
+	if s.logger.Enabled(context.Background(), slog.LevelDebug) {
+		np.logger(c).Debug("recv", "bytes", len(message))
+	}
+	s.capture.record(c.id, mt, message)
+	if s.previewSize > 0 {
+		np.logger(c).Info("preview", "type", mt, "bytes", len(message), "payload", preview(message, s.previewSize))
+	}
+	if s.hmacKey != nil {
+		payload, ok := verify(s.hmacKey, hmacRequest, mt, message)
+		if !ok {
+			writeClose(c.conn, ws.StatusPolicyViolation, "invalid signature")
+			return errInvalidSignature
+		}
+		message = sign(s.hmacKey, hmacEcho, mt, payload)
+	}
+	echoStart := time.Now()
+	if err := c.conn.writeFrames(func(w io.Writer) error {
+		return wsutil.WriteServerMessage(w, hdr.OpCode, message)
+	}); err != nil {
+		return fmt.Errorf("couldn't write: %w", err)
+	}
+	s.metrics.echoed(len(message), time.Since(echoStart))
+	s.vars.echoed(len(message), time.Since(echoStart))
+	c.stats.sent(len(message))
+	return nil
+}
+
+// lockedConn is a connection served with gobwas/ws, whose frames are
+// written by the echo, by shutdown and by the admin API.
+type lockedConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+// writeFrames calls write holding the write lock of the connection, so the
+// frames it writes aren't interleaved with the frames of other writers.
+func (c *lockedConn) writeFrames(write func(w io.Writer) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return write(c.Conn)
+}
+
+// controlHandler answers the control frames of the connection holding its
+// write lock. Payloads are unmasked unless they are read already unmasked,
+// like the ones read with wsutil.Reader.
+func controlHandler(conn *lockedConn, unmasked bool) wsutil.FrameHandlerFunc {
+	return func(hdr ws.Header, r io.Reader) error {
+		var buf bytes.Buffer
+		err := wsutil.ControlHandler{
+			Src:                 r,
+			Dst:                 &buf,
+			State:               ws.StateServerSide,
+			DisableSrcCiphering: unmasked,
+		}.Handle(hdr)
+		if buf.Len() > 0 {
+			if werr := conn.writeFrames(func(w io.Writer) error {
+				_, err := w.Write(buf.Bytes())
+				return err
+			}); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		return err
+	}
+}
+
+// writeClose sends a close frame to the client. Frames being echoed are
+// written first, since a close frame can't be sent in the middle of them.
+func writeClose(conn *lockedConn, code ws.StatusCode, text string) {
+	frame, err := ws.CompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, text)))
+	if err != nil {
+		return
+	}
+	_ = conn.writeFrames(func(w io.Writer) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := w.Write(frame)
+		return err
+	})
+}
+
+// close unregisters and closes the connection, logging the error that
+// ended it.
+func (np *netpoll) close(c *pollConn, err error) {
+	s := np.s
+	np.mu.Lock()
+	// The connection may be closed on shutdown while being handled.
+	if np.conns[c.fd] != c {
+		np.mu.Unlock()
+		return
+	}
+	delete(np.conns, c.fd)
+	np.mu.Unlock()
+	_ = np.poller.remove(c.fd)
+	c.untrack()
+
+	logger := np.logger(c)
+	err = s.hijackedError(logger, err)
+	if cerr := c.conn.Close(); cerr != nil {
+		logger.Error("couldn't close", "error", cerr)
+	}
+	s.metrics.connClosed()
+	s.vars.connClosed()
+	s.accessLog.log(c.r, c.id, c.start, c.subprotocol, true, err)
+}
+
+// stop closes the connections still registered and stops the poller, once
+// the server is shut down.
+func (np *netpoll) stop() {
+	np.stopOnce.Do(func() {
+		np.mu.Lock()
+		conns := make([]*pollConn, 0, len(np.conns))
+		for _, c := range np.conns {
+			conns = append(conns, c)
+		}
+		np.mu.Unlock()
+		for _, c := range conns {
+			np.close(c, errShuttingDown)
+		}
+		if err := np.poller.close(); err != nil {
+			np.s.logger.Error("couldn't stop netpoll", "error", err)
+		}
+	})
+}
+
+// logger returns the logger of the connection, created on demand so idle
+// connections don't hold one.
+func (np *netpoll) logger(c *pollConn) *slog.Logger {
+	return np.s.logger.With("conn", c.id, "remote_addr", c.remoteAddr)
+}
+
+// hijack upgrades the connection with gobwas/ws, taking it over from the
+// http server. The upgrade failure is logged and reported if it fails.
+func (s *Server) hijack(w http.ResponseWriter, r *http.Request, id uint64, start time.Time,
+	logger *slog.Logger) (net.Conn, *bufio.ReadWriter, string, bool) {
+	w, r = extendedConnect(w, r)
+	fail := func(err error) {
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Error("couldn't upgrade", "error", err)
+	}
+	if !s.checkOrigin(r) {
+		fail(errors.New("origin not allowed"))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, nil, "", false
+	}
+	subprotocol := s.subprotocol(r)
+	u := ws.HTTPUpgrader{
+		Protocol: func(p string) bool {
+			return p == subprotocol
+		},
+		Header: connIDHeader(id),
+	}
+	conn, rw, _, err := u.Upgrade(r, w)
+	if err != nil {
+		fail(err)
+		return nil, nil, "", false
+	}
+	return conn, rw, subprotocol, true
+}
+
+// hijackedError logs the error that ended a connection served with
+// gobwas/ws and returns it, or nil if the client closed the connection.
+func (s *Server) hijackedError(logger *slog.Logger, err error) error {
+	var closed wsutil.ClosedError
+	switch {
+	case errors.As(err, &closed), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// Closed connections aren't errors of the server.
+		logger.Info("connection closed", "error", err)
+		return nil
+	case errors.Is(err, errMessageTooBig):
+		s.metrics.oversized()
+		s.vars.oversized()
+		logger.Warn("message too big", "limit", s.maxMessageSize)
+	case errors.Is(err, errInvalidSignature):
+		s.vars.failed()
+		logger.Warn("invalid signature")
+	case errors.Is(err, errInvalidUTF8):
+		s.vars.failed()
+		logger.Warn("invalid UTF-8")
+	case errors.Is(err, errShuttingDown):
+		logger.Warn("closed forcibly on shutdown")
+	default:
+		s.vars.failed()
+		logger.Error("connection failed", "error", err)
+	}
+	return err
+}
+
+// subprotocol returns the first subprotocol supported by the server that is
+// requested by the client.
+func (s *Server) subprotocol(r *http.Request) string {
+	requested := websocket.Subprotocols(r)
+	for _, p := range s.subprotocols {
+		for _, q := range requested {
+			if p == q {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// connFd returns the raw connection and the file descriptor of the
+// connection.
+func connFd(conn net.Conn) (syscall.RawConn, int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't get raw connection: %w", err)
+	}
+	var fd int
+	if err := raw.Control(func(f uintptr) {
+		fd = int(f)
+	}); err != nil {
+		return nil, 0, fmt.Errorf("couldn't get file descriptor: %w", err)
+	}
+	return raw, fd, nil
+}
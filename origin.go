@@ -0,0 +1,49 @@
+package wsecho
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	if s.originCheck != nil {
+		return s.originCheck(r)
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(s.origins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range s.origins {
+		if matchOrigin(o, origin, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin returns true if the pattern matches the origin, or its host
+// if the pattern has no scheme.
+func matchOrigin(pattern, origin, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	target := strings.ToLower(origin)
+	if !strings.Contains(pattern, "://") {
+		target = strings.ToLower(host)
+	}
+	if !strings.Contains(pattern, "*") {
+		return pattern == target
+	}
+	ok, err := path.Match(pattern, target)
+	return err == nil && ok
+}
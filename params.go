@@ -0,0 +1,299 @@
+package wsecho
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// params configure how a connection is served. They are set with server
+// options and overridden by the query parameters of the upgrade request, so
+// each connection can set its own behavior without restarting the server:
+//
+//	delay, jitter, distribution  delay of each echo, e.g. ?delay=250ms
+//	drop                         percentage of messages dropped
+//	corrupt, corruption          percentage of corrupted echoes
+//	bandwidth, read_bandwidth    bytes per second written and read
+//	repeat, repeat_interval      echoes of each message
+//	transform                    transforms applied to payloads
+//	close_after                  messages handled, or time, before closing
+//	close, reason                close code and reason
+//	abort                        abort instead of closing, fin or rst
+//	max_size                     maximum message size, below the server one
+//	seed                         seed of the random faults
+//	ack                          interval of sink acks
+//	size, rate, payload, count   messages pushed by the stream handler
+//	room                         room of broadcast clients
+//
+// They are validated on every upgrade, so invalid ones are refused the same
+// way everywhere, but neither the netpoll backend nor fragments mode apply
+// them.
+type params struct {
+	delay          time.Duration
+	jitter         time.Duration
+	distribution   Distribution
+	seed           int64
+	drop           float64
+	corrupt        float64
+	corruption     Corruption
+	bandwidth      int
+	readBandwidth  int
+	repeat         int
+	repeatInterval time.Duration
+	transforms     []Transform
+	closeAfter     int
+	closeAfterTime time.Duration
+	closeCode      int
+	closeReason    string
+	abort          Abort
+	maxSize        int64
+	ack            time.Duration
+	streamSize     int
+	streamRate     float64
+	streamPayload  PayloadType
+	streamCount    int
+	room           string
+
+	rand        *rand.Rand
+	limiter     *rate.Limiter
+	readLimiter *rate.Limiter
+	sequence    uint64
+}
+
+// WithCloseAfter closes each connection normally once n messages from the
+// client are handled or d elapsed since the upgrade, whichever happens
+// first. Only the echo handler counts messages. Zero values
+// disable each limit. Clients can set either limit for their connection
+// with the close_after query parameter, e.g. ?close_after=10 or
+// ?close_after=5s.
+func WithCloseAfter(n int, d time.Duration) Option {
+	return func(s *Server) {
+		s.params.closeAfter = n
+		s.params.closeAfterTime = d
+	}
+}
+
+// WithCloseCode sets the code and reason of the close frame sent when
+// connections are closed by WithCloseAfter, so clients can be tested against
+// every close code. Without close limits connections are closed right after
+// the upgrade. Clients can set them for their connection with the close and
+// reason query parameters, e.g. ?close=1008&reason=policy&close_after=3.
+func WithCloseCode(code int, reason string) Option {
+	return func(s *Server) {
+		s.params.closeCode = code
+		s.params.closeReason = reason
+	}
+}
+
+// connParams returns the params of the connection, overriding the ones of
+// the server with the query parameters of the request.
+func (s *Server) connParams(r *http.Request, id uint64) (*params, error) {
+	p := s.params
+	p.maxSize = s.maxMessageSize
+	p.room = pathRoom(r.URL.Path)
+	q := r.URL.Query()
+
+	// Keep the first invalid parameter.
+	var invalid error
+	check := func(err error) {
+		if invalid == nil {
+			invalid = err
+		}
+	}
+	check(queryDuration(q, "delay", &p.delay))
+	check(queryDuration(q, "jitter", &p.jitter))
+	if v := q.Get("distribution"); v != "" {
+		d, err := ParseDistribution(v)
+		check(err)
+		p.distribution = d
+	}
+	check(queryPercent(q, "drop", &p.drop))
+	check(queryPercent(q, "corrupt", &p.corrupt))
+	if v := q.Get("corruption"); v != "" {
+		c, err := ParseCorruption(v)
+		check(err)
+		p.corruption = c
+	}
+	check(queryInt(q, "bandwidth", 0, &p.bandwidth))
+	check(queryInt(q, "read_bandwidth", 0, &p.readBandwidth))
+	check(queryInt(q, "repeat", 1, &p.repeat))
+	check(queryDuration(q, "repeat_interval", &p.repeatInterval))
+	if v := q.Get("transform"); v != "" {
+		ts, err := ParseTransforms(v)
+		check(err)
+		p.transforms = ts
+	}
+	if v := q.Get("close_after"); v != "" {
+		// Plain numbers are messages, durations are time.
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			p.closeAfter = n
+		} else {
+			check(queryDuration(q, "close_after", &p.closeAfterTime))
+		}
+	}
+	if v := q.Get("close"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || !validCloseCode(n) {
+			check(fmt.Errorf("invalid close %q", v))
+		}
+		p.closeCode = n
+	}
+	if v := q.Get("abort"); v != "" {
+		a, err := ParseAbort(v)
+		check(err)
+		p.abort = a
+	}
+	if q.Has("reason") {
+		reason := q.Get("reason")
+		if len(reason) > maxCloseReason {
+			check(fmt.Errorf("reason longer than %d bytes", maxCloseReason))
+		}
+		p.closeReason = reason
+	}
+	if v := q.Get("max_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			check(fmt.Errorf("invalid max_size %q", v))
+		} else if p.maxSize <= 0 || n < p.maxSize {
+			// Clients can't raise the limit of the server.
+			p.maxSize = n
+		}
+	}
+	check(queryDuration(q, "ack", &p.ack))
+	check(queryInt(q, "size", 0, &p.streamSize))
+	if v := q.Get("rate"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 {
+			check(fmt.Errorf("invalid rate %q", v))
+		}
+		p.streamRate = r
+	}
+	if v := q.Get("payload"); v != "" {
+		typ := PayloadType(v)
+		check(typ.validate())
+		p.streamPayload = typ
+	}
+	check(queryInt(q, "count", 0, &p.streamCount))
+	if v := q.Get("room"); v != "" {
+		p.room = v
+	}
+	seed := p.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	seed += int64(id)
+	if v := q.Get("seed"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			check(fmt.Errorf("invalid seed %q", v))
+		}
+		seed = n
+	}
+	if invalid != nil {
+		return nil, invalid
+	}
+
+	p.rand = rand.New(rand.NewSource(seed))
+	if p.bandwidth > 0 {
+		p.limiter = rate.NewLimiter(rate.Limit(p.bandwidth), min(p.bandwidth, throttleBurst))
+	}
+	if p.readBandwidth > 0 {
+		p.readLimiter = rate.NewLimiter(rate.Limit(p.readBandwidth), min(p.readBandwidth, throttleBurst))
+	}
+	return &p, nil
+}
+
+// closeFrame returns the code and reason to close the connection with once
+// its close limits are reached.
+func (p *params) closeFrame() (int, string) {
+	if p.closeCode == 0 {
+		return websocket.CloseNormalClosure, p.closeReason
+	}
+	return p.closeCode, p.closeReason
+}
+
+// closeNow returns true if the connection must be closed right after the
+// upgrade.
+func (p *params) closeNow() bool {
+	return (p.closeCode != 0 || p.abort != "") && p.closeAfter <= 0 && p.closeAfterTime <= 0
+}
+
+// maxCloseReason is the longest reason that fits in a close frame, whose
+// payload is limited to 125 bytes including the 2 bytes of the code.
+const maxCloseReason = 123
+
+// validCloseCode returns true if the close code can be sent in a close
+// frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= websocket.CloseNormalClosure && code <= websocket.CloseUnsupportedData:
+		return true
+	case code >= websocket.CloseInvalidFramePayloadData && code <= 1014:
+		// 1012 to 1014 are registered by IANA, the rest are reserved.
+		return true
+	}
+	return code >= 3000 && code < 5000
+}
+
+// queryDuration sets d to the non-negative duration of the query parameter
+// if it is set.
+func queryDuration(q url.Values, name string, d *time.Duration) error {
+	v := q.Get(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	*d = parsed
+	return nil
+}
+
+// queryInt sets n to the integer of the query parameter if it is set,
+// failing if it is lower than lowest.
+func queryInt(q url.Values, name string, lowest int, n *int) error {
+	v := q.Get(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(v)
+	if err != nil || parsed < lowest {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	*n = parsed
+	return nil
+}
+
+// queryPercent sets p to the percentage of the query parameter if it is
+// set.
+func queryPercent(q url.Values, name string, p *float64) error {
+	v := q.Get(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := parsePercent(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*p = parsed
+	return nil
+}
+
+// parsePercent parses a percentage from 0 to 100.
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 100 {
+		return 0, fmt.Errorf("percentage %v out of range", p)
+	}
+	return p, nil
+}
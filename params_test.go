@@ -0,0 +1,197 @@
+package wsecho
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		query string
+		// want changes the params of the server to the expected ones.
+		want func(p *params)
+		err  string
+	}{
+		{
+			name: "defaults",
+			want: func(p *params) {},
+		},
+		{
+			name:  "delay",
+			query: "delay=250ms&jitter=10ms",
+			want: func(p *params) {
+				p.delay = 250 * time.Millisecond
+				p.jitter = 10 * time.Millisecond
+			},
+		},
+		{
+			name:  "negative delay",
+			query: "delay=-1s",
+			err:   `invalid delay "-1s"`,
+		},
+		{
+			name:  "drop",
+			query: "drop=12.5",
+			want:  func(p *params) { p.drop = 12.5 },
+		},
+		{
+			name:  "drop out of range",
+			query: "drop=101",
+			err:   "invalid drop: percentage 101 out of range",
+		},
+		{
+			name:  "close after messages",
+			query: "close_after=10",
+			want:  func(p *params) { p.closeAfter = 10 },
+		},
+		{
+			name:  "close after time",
+			query: "close_after=5s",
+			want:  func(p *params) { p.closeAfterTime = 5 * time.Second },
+		},
+		{
+			name:  "negative close after",
+			query: "close_after=-1",
+			err:   `invalid close_after "-1"`,
+		},
+		{
+			name:  "close code and reason",
+			query: "close=4000&reason=bye",
+			want: func(p *params) {
+				p.closeCode = 4000
+				p.closeReason = "bye"
+			},
+		},
+		{
+			name:  "reserved close code",
+			query: "close=1005",
+			err:   `invalid close "1005"`,
+		},
+		{
+			name:  "invalid close code",
+			query: "close=x",
+			err:   `invalid close "x"`,
+		},
+		{
+			name:  "longest reason",
+			query: "reason=" + strings.Repeat("a", maxCloseReason),
+			want:  func(p *params) { p.closeReason = strings.Repeat("a", maxCloseReason) },
+		},
+		{
+			name:  "reason too long",
+			query: "reason=" + strings.Repeat("a", maxCloseReason+1),
+			err:   "reason longer than 123 bytes",
+		},
+		{
+			name:  "empty reason",
+			opts:  []Option{WithCloseCode(4000, "server")},
+			query: "reason=",
+			want:  func(p *params) { p.closeReason = "" },
+		},
+		{
+			name:  "lower max size",
+			opts:  []Option{WithMaxMessageSize(100)},
+			query: "max_size=10",
+			want:  func(p *params) { p.maxSize = 10 },
+		},
+		{
+			name:  "higher max size",
+			opts:  []Option{WithMaxMessageSize(100)},
+			query: "max_size=1000",
+			want:  func(p *params) {},
+		},
+		{
+			name:  "invalid max size",
+			query: "max_size=0",
+			err:   `invalid max_size "0"`,
+		},
+		{
+			name:  "stream",
+			query: "size=16&rate=2.5&payload=text&count=3",
+			want: func(p *params) {
+				p.streamSize = 16
+				p.streamRate = 2.5
+				p.streamPayload = PayloadText
+				p.streamCount = 3
+			},
+		},
+		{
+			name:  "negative rate",
+			query: "rate=-1",
+			err:   `invalid rate "-1"`,
+		},
+		{
+			name:  "room",
+			query: "room=a",
+			want:  func(p *params) { p.room = "a" },
+		},
+		{
+			name:  "invalid seed",
+			query: "seed=x",
+			err:   `invalid seed "x"`,
+		},
+		{
+			name:  "first invalid",
+			query: "delay=x&seed=x",
+			err:   `invalid delay "x"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(tt.opts...)
+			r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+			got, err := s.connParams(r, 1)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.rand == nil {
+				t.Error("got no random source")
+			}
+			got.rand, got.limiter, got.readLimiter = nil, nil, nil
+			want := s.params
+			want.maxSize = s.maxMessageSize
+			tt.want(&want)
+			if !reflect.DeepEqual(got, &want) {
+				t.Errorf("got params %+v, want %+v", got, &want)
+			}
+		})
+	}
+}
+
+func TestValidCloseCode(t *testing.T) {
+	tests := []struct {
+		code int
+		want bool
+	}{
+		{code: 999},
+		{code: 1000, want: true},
+		{code: 1003, want: true},
+		{code: 1004},
+		{code: 1005},
+		{code: 1006},
+		{code: 1007, want: true},
+		{code: 1011, want: true},
+		{code: 1014, want: true},
+		{code: 1015},
+		{code: 2999},
+		{code: 3000, want: true},
+		{code: 4999, want: true},
+		{code: 5000},
+	}
+	for _, tt := range tests {
+		if got := validCloseCode(tt.code); got != tt.want {
+			t.Errorf("validCloseCode(%d) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
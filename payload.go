@@ -0,0 +1,116 @@
+package wsecho
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// PayloadType is the kind of content sent on each message.
+type PayloadType string
+
+const (
+	// PayloadZero sends messages filled with zeroes.
+	PayloadZero PayloadType = "zero"
+	// PayloadRandom sends random bytes generated from a seed.
+	PayloadRandom PayloadType = "random"
+	// PayloadPattern sends incrementing bytes starting at the message
+	// sequence number.
+	PayloadPattern PayloadType = "pattern"
+	// PayloadText sends printable ASCII text.
+	PayloadText PayloadType = "text"
+)
+
+const printable = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 .,;:!?-"
+
+// payloadGenerator generates the payload of each message.
+type payloadGenerator struct {
+	typ      PayloadType
+	size     int
+	rnd      *rand.Rand
+	payloads [][]byte
+}
+
+// ParsePayloadType parses the name of a payload type.
+func ParsePayloadType(s string) (PayloadType, error) {
+	t := PayloadType(s)
+	if err := t.validate(); err != nil {
+		return "", err
+	}
+	return t, nil
+}
+
+// validate returns an error if the payload type is unknown.
+func (t PayloadType) validate() error {
+	switch t {
+	case "", PayloadZero, PayloadRandom, PayloadPattern, PayloadText:
+		return nil
+	default:
+		return fmt.Errorf("unknown payload type %q", t)
+	}
+}
+
+func newPayloadGenerator(typ PayloadType, size int, seed int64) *payloadGenerator {
+	return &payloadGenerator{
+		typ:  typ,
+		size: size,
+		rnd:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// next returns the payload for the message with the given sequence number.
+func (g *payloadGenerator) next(seq int) []byte {
+	if len(g.payloads) > 0 {
+		return g.payloads[seq%len(g.payloads)]
+	}
+	b := make([]byte, g.size)
+	switch g.typ {
+	case PayloadRandom:
+		_, _ = g.rnd.Read(b)
+	case PayloadPattern:
+		for i := range b {
+			b[i] = byte(seq + i)
+		}
+	case PayloadText:
+		for i := range b {
+			b[i] = printable[(seq+i)%len(printable)]
+		}
+	}
+	return b
+}
+
+// ReadPayloads reads payloads from r to be used with WithPayloads.
+// If lines is true each non-empty line is a separate payload, otherwise the
+// whole content is a single payload.
+func ReadPayloads(r io.Reader, lines bool) ([][]byte, error) {
+	if !lines {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read payload: %w", err)
+		}
+		if len(b) == 0 {
+			return nil, errors.New("empty payload")
+		}
+		return [][]byte{b}, nil
+	}
+	var payloads [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		payloads = append(payloads, append([]byte(nil), line...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read payloads: %w", err)
+	}
+	if len(payloads) == 0 {
+		return nil, errors.New("empty payload")
+	}
+	return payloads, nil
+}
@@ -0,0 +1,121 @@
+package wsecho
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestMatchEcho(t *testing.T) {
+	msg := func(payload string, expired bool) sent {
+		return sent{messageType: 2, payload: []byte(payload), expired: expired}
+	}
+	tests := []struct {
+		name    string
+		pending []sent
+		echo    string
+		want    int
+		rest    int
+	}{
+		{
+			name:    "in order",
+			pending: []sent{msg("a", false), msg("b", false)},
+			echo:    "a",
+			want:    0,
+			rest:    1,
+		},
+		{
+			name:    "lost echo of expired message",
+			pending: []sent{msg("a", true), msg("b", false)},
+			echo:    "b",
+			want:    1,
+			rest:    0,
+		},
+		{
+			name:    "late echo",
+			pending: []sent{msg("a", true), msg("b", false)},
+			echo:    "a",
+			want:    0,
+			rest:    1,
+		},
+		{
+			name:    "same payloads prefer live messages",
+			pending: []sent{msg("a", true), msg("a", false)},
+			echo:    "a",
+			want:    1,
+			rest:    0,
+		},
+		{
+			name:    "lost echo of live message",
+			pending: []sent{msg("a", false), msg("b", false)},
+			echo:    "b",
+			want:    1,
+			rest:    1,
+		},
+		{
+			name:    "mismatch",
+			pending: []sent{msg("a", true), msg("b", false)},
+			echo:    "c",
+			want:    1,
+			rest:    0,
+		},
+		{
+			name:    "unexpected",
+			pending: []sent{msg("a", true)},
+			echo:    "c",
+			want:    -1,
+		},
+		{
+			name: "nothing in flight",
+			echo: "a",
+			want: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchEcho(tt.pending, 2, []byte(tt.echo))
+			if got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+			if got < 0 {
+				return
+			}
+			if rest := popEcho(tt.pending, got); len(rest) != tt.rest {
+				t.Errorf("got %d messages in flight, want %d", len(rest), tt.rest)
+			}
+		})
+	}
+}
+
+func TestPingContinueOnTimeout(t *testing.T) {
+	for _, window := range []int{1, 4} {
+		host := newTestServer(t, WithDrop(10), WithFaultSeed(1))
+		r, err := Ping(context.Background(), host,
+			WithCount(40),
+			WithPayload(PayloadRandom),
+			WithWindow(window),
+			WithMessageTimeout(100*time.Millisecond),
+			WithContinueOnTimeout(true),
+			WithVerbosity(VerbosityQuiet),
+			WithPingLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Timeouts == 0 {
+			t.Fatalf("window %d: no echo was dropped", window)
+		}
+		// The echoes after a lost one are still matched with their messages.
+		if r.Mismatches != 0 {
+			t.Errorf("window %d: got %d mismatches", window, r.Mismatches)
+		}
+		if r.Timeouts > 10 {
+			t.Errorf("window %d: got %d timeouts for 10%% dropped echoes", window, r.Timeouts)
+		}
+		if len(r.Messages) != 40 {
+			t.Errorf("window %d: got %d messages, want 40", window, len(r.Messages))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package wsecho
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller notifies when file descriptors are ready to read using kqueue.
+// Descriptors are added in one-shot mode and must be resumed after each
+// notification.
+type poller struct {
+	fd int
+	// wake is a pipe that stops wait when it is written.
+	wake [2]int
+}
+
+func newPoller() (*poller, error) {
+	fd, err := unix.Kqueue()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create kqueue: %w", err)
+	}
+	unix.CloseOnExec(fd)
+	p := &poller{fd: fd}
+	if err := unix.Pipe(p.wake[:]); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("couldn't create pipe: %w", err)
+	}
+	unix.CloseOnExec(p.wake[0])
+	unix.CloseOnExec(p.wake[1])
+	if err := p.ctl(p.wake[0], unix.EV_ADD); err != nil {
+		p.release()
+		return nil, fmt.Errorf("couldn't register pipe: %w", err)
+	}
+	return p, nil
+}
+
+// release closes the file descriptors of the poller.
+func (p *poller) release() {
+	_ = unix.Close(p.wake[0])
+	_ = unix.Close(p.wake[1])
+	_ = unix.Close(p.fd)
+}
+
+func (p *poller) add(fd int) error {
+	return p.ctl(fd, unix.EV_ADD|unix.EV_ONESHOT)
+}
+
+func (p *poller) resume(fd int) error {
+	return p.ctl(fd, unix.EV_ADD|unix.EV_ONESHOT)
+}
+
+func (p *poller) remove(fd int) error {
+	// One-shot events are already deleted once they fire.
+	if err := p.ctl(fd, unix.EV_DELETE); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+func (p *poller) ctl(fd int, flags int) error {
+	var ev unix.Kevent_t
+	unix.SetKevent(&ev, fd, unix.EVFILT_READ, flags)
+	_, err := unix.Kevent(p.fd, []unix.Kevent_t{ev}, nil, nil)
+	return err
+}
+
+// close stops wait, which releases the poller.
+func (p *poller) close() error {
+	_, err := unix.Write(p.wake[1], []byte{1})
+	return err
+}
+
+// read reads the data available on the file descriptor without waiting
+// for more.
+func (p *poller) read(fd uintptr, b []byte) (int, error) {
+	n, err := unix.Read(int(fd), b)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// wait calls ready for each file descriptor ready to read until the poller
+// fails or is closed.
+func (p *poller) wait(ready func(fd int)) error {
+	defer p.release()
+	events := make([]unix.Kevent_t, 256)
+	for {
+		n, err := unix.Kevent(p.fd, nil, events, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't wait for kqueue events: %w", err)
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Ident) == p.wake[0] {
+				return nil
+			}
+			ready(int(ev.Ident))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package wsecho
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller notifies when file descriptors are ready to read using epoll.
+// Descriptors are added in one-shot mode and must be resumed after each
+// notification.
+type poller struct {
+	fd int
+	// wake is an eventfd that stops wait when it is written.
+	wake int
+}
+
+func newPoller() (*poller, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create epoll: %w", err)
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("couldn't create eventfd: %w", err)
+	}
+	ev := &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wake)}
+	if err := unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, wake, ev); err != nil {
+		_ = unix.Close(wake)
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("couldn't register eventfd: %w", err)
+	}
+	return &poller{fd: fd, wake: wake}, nil
+}
+
+func (p *poller) add(fd int) error {
+	return p.ctl(unix.EPOLL_CTL_ADD, fd)
+}
+
+func (p *poller) resume(fd int) error {
+	return p.ctl(unix.EPOLL_CTL_MOD, fd)
+}
+
+func (p *poller) remove(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *poller) ctl(op, fd int) error {
+	ev := &unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT,
+		Fd:     int32(fd),
+	}
+	return unix.EpollCtl(p.fd, op, fd, ev)
+}
+
+// close stops wait, which releases the poller.
+func (p *poller) close() error {
+	var b [8]byte
+	binary.NativeEndian.PutUint64(b[:], 1)
+	_, err := unix.Write(p.wake, b[:])
+	return err
+}
+
+// read reads the data available on the file descriptor without waiting
+// for more.
+func (p *poller) read(fd uintptr, b []byte) (int, error) {
+	n, err := unix.Read(int(fd), b)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// wait calls ready for each file descriptor ready to read until the poller
+// fails or is closed.
+func (p *poller) wait(ready func(fd int)) error {
+	defer func() {
+		_ = unix.Close(p.wake)
+		_ = unix.Close(p.fd)
+	}()
+	events := make([]unix.EpollEvent, 256)
+	for {
+		n, err := unix.EpollWait(p.fd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't wait for epoll events: %w", err)
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == p.wake {
+				return nil
+			}
+			ready(int(ev.Fd))
+		}
+	}
+}
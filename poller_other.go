@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package wsecho
+
+import "errors"
+
+// poller isn't available on this platform.
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("netpoll isn't supported on this platform")
+}
+
+func (p *poller) add(fd int) error    { return nil }
+func (p *poller) resume(fd int) error { return nil }
+func (p *poller) remove(fd int) error { return nil }
+func (p *poller) close() error        { return nil }
+
+func (p *poller) read(fd uintptr, b []byte) (int, error) { return 0, nil }
+
+func (p *poller) wait(ready func(fd int)) error { return nil }
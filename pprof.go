@@ -0,0 +1,35 @@
+package wsecho
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// ServePprof serves the net/http/pprof profiling endpoints under
+// /debug/pprof/ on a separate admin address, so they aren't exposed to
+// websocket clients. The default slog logger is used if logger is nil.
+func ServePprof(ctx context.Context, addr string, logger *slog.Logger) error {
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Info("pprof listening", "addr", ln.Addr().String())
+	return serveHandler(ctx, []listener{httpListener(ln)}, PprofHandler(), logger, nil)
+}
+
+// PprofHandler returns an http.Handler serving the net/http/pprof profiling
+// endpoints under /debug/pprof/.
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
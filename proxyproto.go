@@ -0,0 +1,265 @@
+package wsecho
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// proxyHeaderTimeout is the time to wait for the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// defaultProxyTrusted are the peers the header is read from if no trusted
+// prefixes are provided.
+var defaultProxyTrusted = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// proxyV2Signature starts PROXY protocol v2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WithProxyProtocol accepts the HAProxy PROXY protocol v1 and v2 header on
+// incoming connections, so the address of the client behind an L4 load
+// balancer is the one logged and checked by WithAllowedCIDRs. The header is
+// only read from peers in the trusted prefixes, or from loopback and unix
+// socket peers if none are provided, and connections without it are served
+// with their own address.
+func WithProxyProtocol(enabled bool, trusted ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.proxyProtocol = enabled
+		s.proxyTrusted = trusted
+	}
+}
+
+// proxyListener reads the PROXY protocol header of the accepted
+// connections.
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trust(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// trust returns true if the header is read from the peer.
+func (l *proxyListener) trust(addr net.Addr) bool {
+	trusted := l.trusted
+	if len(trusted) == 0 {
+		if addr.Network() == "unix" {
+			return true
+		}
+		trusted = defaultProxyTrusted
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range trusted {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection whose addresses are the ones of its PROXY
+// protocol header. The header is read on first use, in the goroutine
+// serving the connection instead of the accepting one.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.local, c.err = readProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("couldn't read proxy header: %w", c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	// Read directly once the data buffered with the header is consumed,
+	// so pollers watching the file descriptor don't miss it.
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// SyscallConn returns the raw underlying connection for the netpoll backend.
+func (c *proxyConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %T", c.Conn)
+	}
+	return sc.SyscallConn()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, returning the
+// source and destination addresses, or nil ones if the header is missing
+// or carries no addresses.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, nil, nil
+		}
+		return readProxyV1(r)
+	case '\r':
+		if b, err := r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, nil, nil
+		}
+		return readProxyV2(r)
+	}
+	return nil, nil, nil
+}
+
+// readProxyV1 reads a human readable header, e.g.
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n.
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The header is at most 107 bytes long.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("invalid v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func proxyV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch cmd := hdr[12] & 0x0f; cmd {
+	case 0:
+		// Local connections, e.g. health checks, keep their addresses.
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", cmd)
+	}
+	var size int
+	switch hdr[13] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		// Unix and unspecified addresses aren't used.
+		return nil, nil, nil
+	}
+	// Addresses are followed by the ports and optional TLVs, which are
+	// skipped.
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("short v2 addresses")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	src := net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	dst := net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	return src, dst, nil
+}
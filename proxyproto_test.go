@@ -0,0 +1,177 @@
+package wsecho
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	// v2 returns a v2 header with the version and command, the family and
+	// the body.
+	v2 := func(verCmd, family byte, body ...byte) string {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, verCmd, family)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+		return string(append(b, body...))
+	}
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	tcp6 := make([]byte, 0, 36)
+	tcp6 = append(tcp6, net.ParseIP("2001:db8::1")...)
+	tcp6 = append(tcp6, net.ParseIP("2001:db8::2")...)
+	tcp6 = append(tcp6, 0xdc, 0x04, 0x01, 0xbb)
+
+	tests := []struct {
+		name    string
+		data    string
+		src     string
+		dst     string
+		rest    string
+		wantErr bool
+	}{
+		{
+			name: "no header",
+			data: "GET / HTTP/1.1\r\n",
+			rest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name: "short",
+			data: "PRO",
+			rest: "PRO",
+		},
+		{
+			name: "v1 tcp4",
+			data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET",
+			src:  "192.0.2.1:56324",
+			dst:  "198.51.100.1:443",
+			rest: "GET",
+		},
+		{
+			name: "v1 tcp6",
+			data: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			src:  "[2001:db8::1]:56324",
+			dst:  "[2001:db8::2]:443",
+		},
+		{
+			name: "v1 unknown",
+			data: "PROXY UNKNOWN ignored\r\nGET",
+			rest: "GET",
+		},
+		{
+			name:    "v1 without crlf",
+			data:    "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\nGET",
+			wantErr: true,
+		},
+		{
+			name:    "v1 too long",
+			data:    "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "v1 udp",
+			data:    "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "v1 missing port",
+			data:    "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "v1 invalid address",
+			data:    "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "v1 invalid port",
+			data:    "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n",
+			wantErr: true,
+		},
+		{
+			name: "v2 tcp4",
+			data: v2(0x21, 0x11, tcp4...) + "GET",
+			src:  "192.0.2.1:56324",
+			dst:  "198.51.100.1:443",
+			rest: "GET",
+		},
+		{
+			name: "v2 tcp6",
+			data: v2(0x21, 0x21, tcp6...),
+			src:  "[2001:db8::1]:56324",
+			dst:  "[2001:db8::2]:443",
+		},
+		{
+			name: "v2 tlvs",
+			data: v2(0x21, 0x11, append(tcp4, 0x04, 0x00, 0x00)...) + "GET",
+			src:  "192.0.2.1:56324",
+			dst:  "198.51.100.1:443",
+			rest: "GET",
+		},
+		{
+			name: "v2 local",
+			data: v2(0x20, 0x00) + "GET",
+			rest: "GET",
+		},
+		{
+			name: "v2 unix",
+			data: v2(0x21, 0x31, make([]byte, 216)...) + "GET",
+			rest: "GET",
+		},
+		{
+			name: "v2 wrong signature",
+			data: "\r\n\r\nGET",
+			rest: "\r\n\r\nGET",
+		},
+		{
+			name:    "v2 unsupported version",
+			data:    v2(0x11, 0x11, tcp4...),
+			wantErr: true,
+		},
+		{
+			name:    "v2 unsupported command",
+			data:    v2(0x22, 0x11, tcp4...),
+			wantErr: true,
+		},
+		{
+			name:    "v2 short addresses",
+			data:    v2(0x21, 0x11, tcp4[:8]...),
+			wantErr: true,
+		},
+		{
+			name:    "v2 truncated",
+			data:    v2(0x21, 0x11, tcp4...)[:20],
+			wantErr: true,
+		},
+	}
+	addr := func(a net.Addr) string {
+		if a == nil {
+			return ""
+		}
+		return a.String()
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.data))
+			src, dst, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if addr(src) != tt.src || addr(dst) != tt.dst {
+				t.Errorf("got addresses %q %q, want %q %q", addr(src), addr(dst), tt.src, tt.dst)
+			}
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("got rest %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package wsecho
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// statsdPacketSize is the maximum size of a statsd packet, chosen to fit in
+// a single ethernet frame.
+const statsdPacketSize = 1432
+
+// PushStatsD sends the round trip time of each message as a statsd timing
+// and the summary statistics as gauges to the statsd server at addr.
+// Metric names are prefixed with prefix if it isn't empty.
+func PushStatsD(addr, prefix string, r *Result) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("couldn't dial statsd: %w", err)
+	}
+	defer conn.Close()
+
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	var lines []string
+	for _, d := range r.RTTs {
+		lines = append(lines, fmt.Sprintf("%srtt:%f|ms", prefix, ms(d)))
+	}
+	gauges := []struct {
+		name  string
+		value float64
+	}{
+		{"messages", float64(len(r.RTTs))},
+		{"errors", float64(r.Errors)},
+		{"mismatches", float64(r.Mismatches)},
+		{"timeouts", float64(r.Timeouts)},
+		{"lost", float64(r.Lost)},
+		{"reconnects", float64(r.Reconnects)},
+		{"bytes_sent", float64(r.BytesSent)},
+		{"bytes_received", float64(r.BytesReceived)},
+		{"rtt_min", ms(r.Min)},
+		{"rtt_avg", ms(r.Avg)},
+		{"rtt_max", ms(r.Max)},
+		{"rtt_stddev", ms(r.StdDev)},
+		{"rtt_jitter", ms(r.Jitter)},
+		{"rtt_p50", ms(r.P50)},
+		{"rtt_p90", ms(r.P90)},
+		{"rtt_p99", ms(r.P99)},
+		{"throughput", r.Throughput},
+		{"message_rate", r.MessageRate},
+	}
+	for _, g := range gauges {
+		lines = append(lines, fmt.Sprintf("%s%s:%f|g", prefix, g.name, g.value))
+	}
+
+	// Batch lines into packets.
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdPacketSize {
+			if _, err := conn.Write(packet); err != nil {
+				return fmt.Errorf("couldn't write statsd: %w", err)
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := conn.Write(packet); err != nil {
+			return fmt.Errorf("couldn't write statsd: %w", err)
+		}
+	}
+	return nil
+}
+
+// PushGateway pushes a histogram of the round trip times and the summary
+// statistics as gauges to the prometheus pushgateway at url under the given
+// job name.
+func PushGateway(url, job string, r *Result) error {
+	rtt := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "wsecho_ping_rtt_seconds",
+		Help:    "Round trip time of echoed messages.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+	for _, d := range r.RTTs {
+		rtt.Observe(d.Seconds())
+	}
+	summary := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wsecho_ping_rtt_summary_seconds",
+		Help: "Summary statistics of the round trip times.",
+	}, []string{"stat"})
+	for stat, d := range map[string]time.Duration{
+		"min":    r.Min,
+		"avg":    r.Avg,
+		"max":    r.Max,
+		"stddev": r.StdDev,
+		"jitter": r.Jitter,
+		"p50":    r.P50,
+		"p90":    r.P90,
+		"p99":    r.P99,
+	} {
+		summary.WithLabelValues(stat).Set(d.Seconds())
+	}
+	counts := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wsecho_ping_count",
+		Help: "Counts of the ping run.",
+	}, []string{"type"})
+	for typ, v := range map[string]float64{
+		"messages":       float64(len(r.RTTs)),
+		"errors":         float64(r.Errors),
+		"mismatches":     float64(r.Mismatches),
+		"timeouts":       float64(r.Timeouts),
+		"lost":           float64(r.Lost),
+		"reconnects":     float64(r.Reconnects),
+		"bytes_sent":     float64(r.BytesSent),
+		"bytes_received": float64(r.BytesReceived),
+	} {
+		counts.WithLabelValues(typ).Set(v)
+	}
+	throughput := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wsecho_ping_throughput_bytes",
+		Help: "Bytes echoed per second.",
+	})
+	throughput.Set(r.Throughput)
+
+	if err := push.New(url, job).
+		Collector(rtt).
+		Collector(summary).
+		Collector(counts).
+		Collector(throughput).
+		Push(); err != nil {
+		return fmt.Errorf("couldn't push metrics: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package wsecho
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// RedirectHandler returns an http.Handler redirecting every request to the
+// same host over TLS on the port of addr, e.g. :8443, so plaintext clients
+// of a TLS server are pointed to it. Browser requests are redirected to
+// https and websocket upgrades to wss, which websocket clients don't follow
+// but report as a failed handshake, making misconfigured clients obvious.
+func (s *Server) RedirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		scheme := "https"
+		if websocket.IsWebSocketUpgrade(r) {
+			scheme = "wss"
+			s.logger.Warn("redirecting plaintext upgrade", "remote_addr", r.RemoteAddr, "uri", r.RequestURI)
+		}
+		u := url.URL{Scheme: scheme, Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
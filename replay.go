@@ -0,0 +1,68 @@
+package wsecho
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// WithReplay replays the records of a capture instead of generating
+// payloads. Each captured connection is replayed on its own connection,
+// sending its messages with their original type and timing divided by
+// speed. Messages are sent without delays if speed is zero.
+func WithReplay(records []CaptureRecord, speed float64) PingOption {
+	return func(c *pingConfig) {
+		c.replay = groupRecords(records)
+		c.replaySpeed = speed
+		if len(records) > 0 {
+			c.replayOrigin = c.replay[0][0].Time
+			for _, recs := range c.replay {
+				if recs[0].Time.Before(c.replayOrigin) {
+					c.replayOrigin = recs[0].Time
+				}
+			}
+		}
+	}
+}
+
+// groupRecords groups the records by connection, ordered by the time of the
+// first message of each connection.
+func groupRecords(records []CaptureRecord) [][]CaptureRecord {
+	byConn := map[uint64][]CaptureRecord{}
+	var conns []uint64
+	for _, r := range records {
+		if _, ok := byConn[r.Conn]; !ok {
+			conns = append(conns, r.Conn)
+		}
+		byConn[r.Conn] = append(byConn[r.Conn], r)
+	}
+	var groups [][]CaptureRecord
+	for _, conn := range conns {
+		recs := byConn[conn]
+		sort.SliceStable(recs, func(i, j int) bool {
+			return recs[i].Time.Before(recs[j].Time)
+		})
+		groups = append(groups, recs)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i][0].Time.Before(groups[j][0].Time)
+	})
+	return groups
+}
+
+// replayWait waits until the message seq of connection id must be replayed,
+// relative to the start of the replay.
+func (c *pingConfig) replayWait(ctx context.Context, id, seq int, start time.Time) {
+	if c.replaySpeed <= 0 {
+		return
+	}
+	offset := c.replay[id][seq].Time.Sub(c.replayOrigin)
+	wait := time.Until(start.Add(time.Duration(float64(offset) / c.replaySpeed)))
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+}
@@ -0,0 +1,294 @@
+package wsecho
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Message contains the details of a single echoed message.
+type Message struct {
+	// Conn is the index of the connection the message was sent on.
+	Conn int `json:"conn"`
+	// Seq is the sequence number of the message, starting at 0.
+	Seq int `json:"seq"`
+	// Size is the size in bytes of the message sent.
+	Size int `json:"size"`
+	// Sent is the time the message was sent.
+	Sent time.Time `json:"sent"`
+	// RTT is the round trip time of the message.
+	RTT time.Duration `json:"rtt"`
+	// Mismatch is true if the echoed message didn't match the sent one.
+	Mismatch bool `json:"mismatch"`
+	// Timeout is true if the message wasn't echoed in time, or was lost for
+	// udp:// hosts.
+	Timeout bool `json:"timeout"`
+	// Warmup is true if the message was sent during the warm up phase and
+	// is excluded from the statistics.
+	Warmup bool `json:"warmup"`
+}
+
+// Result contains the statistics of a Ping run.
+// Durations are encoded to JSON as nanoseconds.
+type Result struct {
+	// Proto is the HTTP version that carried the handshake, HTTP/1.1,
+	// HTTP/2.0 with WithHTTP2 or HTTP/3.0 with WithPingWebTransport, or tcp
+	// for tcp:// and udp for udp:// hosts.
+	Proto string `json:"proto,omitempty"`
+	// Subprotocol is the subprotocol negotiated with the server.
+	Subprotocol string `json:"subprotocol,omitempty"`
+	// Compression is true if permessage-deflate compression was negotiated.
+	Compression bool `json:"compression"`
+	// Messages are the details of each echoed message.
+	Messages []Message `json:"messages"`
+	// RTTs are the round trip times of each echoed message, excluding
+	// timed out and warm up messages.
+	RTTs []time.Duration `json:"-"`
+	// Min is the minimum round trip time.
+	Min time.Duration `json:"min"`
+	// Avg is the average round trip time.
+	Avg time.Duration `json:"avg"`
+	// Max is the maximum round trip time.
+	Max time.Duration `json:"max"`
+	// StdDev is the standard deviation of the round trip times.
+	StdDev time.Duration `json:"stddev"`
+	// Jitter is the mean absolute difference between the round trip times
+	// of consecutive messages on the same connection.
+	Jitter time.Duration `json:"jitter"`
+	// P50 is the median round trip time.
+	P50 time.Duration `json:"p50"`
+	// P90 is the 90th percentile round trip time.
+	P90 time.Duration `json:"p90"`
+	// P99 is the 99th percentile round trip time.
+	P99 time.Duration `json:"p99"`
+	// Duration is the wall clock time of the run.
+	Duration time.Duration `json:"duration"`
+	// Throughput is the number of bytes echoed per second.
+	Throughput float64 `json:"throughput"`
+	// MessageRate is the number of messages echoed per second.
+	MessageRate float64 `json:"message_rate"`
+	// Errors is the number of failed reads or writes.
+	Errors int `json:"errors"`
+	// Mismatches is the number of echoed messages whose type, length or
+	// content didn't match the sent message.
+	Mismatches int `json:"mismatches"`
+	// Timeouts is the number of messages not echoed in time.
+	Timeouts int `json:"timeouts"`
+	// Lost is the number of datagrams sent to udp:// hosts not echoed in
+	// time.
+	Lost int `json:"lost"`
+	// Loss is the fraction of datagrams lost.
+	Loss float64 `json:"loss"`
+	// Reconnects is the number of times connections were re-established.
+	Reconnects int `json:"reconnects"`
+	// InvalidSignatures is the number of echoes with an invalid HMAC
+	// signature.
+	InvalidSignatures int `json:"invalid_signatures"`
+	// BytesSent is the total number of bytes sent.
+	BytesSent int64 `json:"bytes_sent"`
+	// BytesReceived is the total number of bytes received.
+	BytesReceived int64 `json:"bytes_received"`
+	// ControlRTTs are the round trip times of the ping control frames sent
+	// with WithControlFrames.
+	ControlRTTs []time.Duration `json:"-"`
+	// Control contains the statistics of the ping control frames, nil
+	// unless WithControlFrames is enabled.
+	Control *ControlResult `json:"control,omitempty"`
+}
+
+// ControlResult contains the statistics of the ping control frames sent
+// along with messages, to compare them with the round trip times of data
+// frames.
+type ControlResult struct {
+	// Pings is the number of ping frames sent.
+	Pings int `json:"pings"`
+	// Pongs is the number of pong frames received for them.
+	Pongs int `json:"pongs"`
+	// Min is the minimum round trip time.
+	Min time.Duration `json:"min"`
+	// Avg is the average round trip time.
+	Avg time.Duration `json:"avg"`
+	// Max is the maximum round trip time.
+	Max time.Duration `json:"max"`
+	// StdDev is the standard deviation of the round trip times.
+	StdDev time.Duration `json:"stddev"`
+	// P50 is the median round trip time.
+	P50 time.Duration `json:"p50"`
+	// P90 is the 90th percentile round trip time.
+	P90 time.Duration `json:"p90"`
+	// P99 is the 99th percentile round trip time.
+	P99 time.Duration `json:"p99"`
+}
+
+// markWarmup flags the first n messages and the ones sent within d of the
+// first message as warm up messages.
+func (r *Result) markWarmup(n int, d time.Duration) {
+	if len(r.Messages) == 0 {
+		return
+	}
+	start := r.Messages[0].Sent
+	for i := range r.Messages {
+		m := &r.Messages[i]
+		if m.Seq < n || m.Sent.Before(start.Add(d)) {
+			m.Warmup = true
+		}
+	}
+}
+
+// summarize computes the summary statistics from the round trip times.
+func (r *Result) summarize() {
+	if r.Duration > 0 {
+		r.Throughput = float64(r.BytesReceived) / r.Duration.Seconds()
+		r.MessageRate = float64(len(r.RTTs)) / r.Duration.Seconds()
+	}
+	if r.Lost > 0 {
+		r.Loss = float64(r.Lost) / float64(len(r.Messages))
+	}
+	if c := r.Control; c != nil {
+		c.Pongs = len(r.ControlRTTs)
+		c.Min, c.Avg, c.Max, c.StdDev = stats(r.ControlRTTs)
+		c.P50 = percentile(r.ControlRTTs, 50)
+		c.P90 = percentile(r.ControlRTTs, 90)
+		c.P99 = percentile(r.ControlRTTs, 99)
+	}
+	if len(r.RTTs) == 0 {
+		return
+	}
+	r.Min, r.Avg, r.Max, r.StdDev = stats(r.RTTs)
+
+	var diffs, n int64
+	last := map[int]time.Duration{}
+	for _, m := range r.Messages {
+		if m.Timeout || m.Warmup {
+			continue
+		}
+		if prev, ok := last[m.Conn]; ok {
+			diff := m.RTT - prev
+			if diff < 0 {
+				diff = -diff
+			}
+			diffs += int64(diff)
+			n++
+		}
+		last[m.Conn] = m.RTT
+	}
+	if n > 0 {
+		r.Jitter = time.Duration(diffs / n)
+	}
+
+	r.P50 = r.Percentile(50)
+	r.P90 = r.Percentile(90)
+	r.P99 = r.Percentile(99)
+}
+
+// stats returns the minimum, average, maximum and standard deviation of the
+// round trip times.
+func stats(rtts []time.Duration) (min, avg, max, stddev time.Duration) {
+	if len(rtts) == 0 {
+		return 0, 0, 0, 0
+	}
+	var sum time.Duration
+	min, max = rtts[0], rtts[0]
+	for _, d := range rtts {
+		sum += d
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	avg = sum / time.Duration(len(rtts))
+
+	var variance float64
+	for _, d := range rtts {
+		diff := float64(d - avg)
+		variance += diff * diff
+	}
+	stddev = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	return min, avg, max, stddev
+}
+
+// Percentile returns the round trip time below which p percent of the
+// samples fall, using the nearest-rank method.
+func (r *Result) Percentile(p float64) time.Duration {
+	return percentile(r.RTTs, p)
+}
+
+// percentile returns the round trip time below which p percent of the
+// samples fall, using the nearest-rank method.
+func percentile(rtts []time.Duration, p float64) time.Duration {
+	if len(rtts) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// Histogram returns an HDR histogram of the round trip times recorded in
+// microseconds, from 1µs up to 1 minute with 3 significant digits.
+func (r *Result) Histogram() *hdrhistogram.Histogram {
+	h := hdrhistogram.New(1, time.Minute.Microseconds(), 3)
+	for _, d := range r.RTTs {
+		// Values out of range are clamped to the highest trackable value.
+		v := d.Microseconds()
+		if v > h.HighestTrackableValue() {
+			v = h.HighestTrackableValue()
+		}
+		_ = h.RecordValue(v)
+	}
+	return h
+}
+
+// WriteHistogram writes the HDR histogram of the round trip times in the
+// percentile distribution (hgrm) format with values in milliseconds.
+func (r *Result) WriteHistogram(w io.Writer) error {
+	if _, err := r.Histogram().PercentilesPrint(w, 5, 1000); err != nil {
+		return fmt.Errorf("couldn't write histogram: %w", err)
+	}
+	return nil
+}
+
+// WriteCSV writes the connection, sequence number, size, send timestamp,
+// round trip time in nanoseconds, mismatch, timeout and warm up flags of each
+// message in CSV format.
+func (r *Result) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"conn", "seq", "size", "sent", "rtt_ns", "mismatch", "timeout", "warmup"}); err != nil {
+		return fmt.Errorf("couldn't write csv: %w", err)
+	}
+	for _, m := range r.Messages {
+		if err := cw.Write([]string{
+			strconv.Itoa(m.Conn),
+			strconv.Itoa(m.Seq),
+			strconv.Itoa(m.Size),
+			m.Sent.Format(time.RFC3339Nano),
+			strconv.FormatInt(m.RTT.Nanoseconds(), 10),
+			strconv.FormatBool(m.Mismatch),
+			strconv.FormatBool(m.Timeout),
+			strconv.FormatBool(m.Warmup),
+		}); err != nil {
+			return fmt.Errorf("couldn't write csv: %w", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("couldn't write csv: %w", err)
+	}
+	return nil
+}
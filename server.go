@@ -0,0 +1,905 @@
+package wsecho
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server is an http.Handler that echoes back websocket messages.
+type Server struct {
+	upgrader       websocket.Upgrader
+	maxMessageSize int64
+	origins        []string
+	originCheck    func(r *http.Request) bool
+	tokens         []string
+	basicAuth      *basicAuth
+	jwt            *jwtValidator
+	hmacKey        []byte
+	allowed        []netip.Prefix
+	denied         []netip.Prefix
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	subprotocols   []string
+	compression    bool
+	metrics        *metrics
+	vars           *vars
+	expvar         bool
+	stats          bool
+	dashboard      bool
+	version        string
+	proxyProtocol  bool
+	proxyTrusted   []netip.Prefix
+	trustedProxies []netip.Prefix
+	started        time.Time
+	accessLog      *accessLog
+	logger         *slog.Logger
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+	previewSize    int
+	capture        *capture
+	lastID         atomic.Uint64
+
+	readBufferSize  int
+	writeBufferSize int
+	noWritePool     bool
+
+	keepaliveInterval  time.Duration
+	keepaliveMaxMissed int
+	idleTimeout        time.Duration
+
+	netpollEnabled bool
+	netpoll        *netpoll
+
+	library Library
+
+	autobahn         bool
+	noUTF8Validation bool
+
+	fragments bool
+
+	handshakeInfo bool
+
+	params params
+
+	hub            *hub
+	broadcastQueue int
+
+	tracker      *tracker
+	drainTimeout time.Duration
+	drainSignals []os.Signal
+
+	adminAddr  string
+	adminToken string
+
+	webTransportAddr string
+	webTransportCert string
+	webTransportKey  string
+
+	tcpEchoAddr string
+	udpEchoAddr string
+
+	sockJS *sockJSSessions
+	eio    *eioSessions
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxMessageSize sets the maximum size in bytes of a message read from
+// the client. Connections sending larger messages are closed with status
+// 1009 (message too big).
+func WithMaxMessageSize(n int64) Option {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithOrigins sets the origins allowed to connect to the server, matched
+// case-insensitively. Origins can contain * wildcards, e.g.
+// https://*.example.com, and origins without scheme are matched against
+// the origin host. A single * allows all origins. Only same-origin requests
+// and requests without Origin header are allowed by default.
+func WithOrigins(origins ...string) Option {
+	return func(s *Server) {
+		s.origins = origins
+	}
+}
+
+// WithOriginCheck sets a callback deciding whether the origin of the
+// request is allowed, taking precedence over WithOrigins.
+func WithOriginCheck(check func(r *http.Request) bool) Option {
+	return func(s *Server) {
+		s.originCheck = check
+	}
+}
+
+// WithBufferSizes sets the sizes in bytes of the read and write buffers of
+// each connection. The websocket library defaults are used for zero sizes.
+// Smaller buffers reduce the memory used by idle connections.
+func WithBufferSizes(read, write int) Option {
+	return func(s *Server) {
+		s.readBufferSize = read
+		s.writeBufferSize = write
+	}
+}
+
+// WithWriteBufferPool sets whether write buffers are shared across
+// connections through a pool, so idle connections don't hold a write
+// buffer. It is enabled by default.
+func WithWriteBufferPool(enabled bool) Option {
+	return func(s *Server) {
+		s.noWritePool = !enabled
+	}
+}
+
+// WithReadTimeout sets the maximum time to wait for the next message from
+// the client.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout sets the maximum time to write each message to the
+// client, so stalled clients don't block the server indefinitely.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithSubprotocols sets the subprotocols supported by the server, in order
+// of preference.
+func WithSubprotocols(protocols ...string) Option {
+	return func(s *Server) {
+		s.subprotocols = protocols
+	}
+}
+
+// WithCompression enables permessage-deflate compression if the client
+// supports it.
+func WithCompression(enabled bool) Option {
+	return func(s *Server) {
+		s.compression = enabled
+	}
+}
+
+// WithMetrics enables collecting prometheus metrics, served by
+// MetricsHandler.
+func WithMetrics(enabled bool) Option {
+	return func(s *Server) {
+		s.metrics = nil
+		if enabled {
+			s.metrics = newMetrics()
+		}
+	}
+}
+
+// WithExpvar enables publishing internal counters in expvar format, served
+// by ExpvarHandler.
+func WithExpvar(enabled bool) Option {
+	return func(s *Server) {
+		s.expvar = enabled
+	}
+}
+
+// WithAccessLog writes an access log entry in JSON lines format to w for
+// each upgrade request once the connection ends.
+func WithAccessLog(w io.Writer) Option {
+	return func(s *Server) {
+		s.accessLog = nil
+		if w != nil {
+			s.accessLog = newAccessLog(w)
+		}
+	}
+}
+
+// WithLogger sets the logger used to report connection events. The default
+// slog logger is used by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithPayloadPreview logs a preview of the first n bytes of each received
+// message, as text if it is valid UTF-8 or as hex otherwise.
+func WithPayloadPreview(n int) Option {
+	return func(s *Server) {
+		s.previewSize = n
+	}
+}
+
+// WithCapture records every message received by the server to w in JSON
+// lines format, to be read back with ReadCapture.
+func WithCapture(w io.Writer) Option {
+	return func(s *Server) {
+		s.capture = nil
+		if w != nil {
+			s.capture = newCapture(w)
+		}
+	}
+}
+
+// WithHMAC verifies the HMAC-SHA256 signature appended by the client to each
+// message and signs the echo with the same key. Connections sending
+// messages with an invalid signature are closed with status 1008 (policy
+// violation).
+func WithHMAC(key []byte) Option {
+	return func(s *Server) {
+		s.hmacKey = key
+	}
+}
+
+// WithTracerProvider sets the OpenTelemetry tracer provider used to trace
+// connections and messages. The global provider is used by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracerProvider = tp
+	}
+}
+
+// NewServer creates a new echo server.
+func NewServer(opts ...Option) *Server {
+	s := &Server{started: time.Now()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// The counters are also served by StatsHandler.
+	s.vars = newVars()
+	if s.tracerProvider == nil {
+		s.tracerProvider = otel.GetTracerProvider()
+	}
+	s.tracer = s.tracerProvider.Tracer(tracerName)
+	if s.library == "" {
+		s.library = defaultLibrary
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.accessLog != nil {
+		s.accessLog.logger = s.logger
+	}
+	if s.capture != nil {
+		s.capture.logger = s.logger
+	}
+	s.upgrader = websocket.Upgrader{
+		ReadBufferSize:    s.readBufferSize,
+		WriteBufferSize:   s.writeBufferSize,
+		CheckOrigin:       s.checkOrigin,
+		Subprotocols:      s.subprotocols,
+		EnableCompression: s.compression,
+	}
+	if !s.noWritePool {
+		s.upgrader.WriteBufferPool = &sync.Pool{}
+	}
+	s.hub = newHub()
+	s.tracker = newTracker()
+	s.sockJS = newSockJSSessions()
+	s.eio = newEIOSessions()
+	if s.broadcastQueue <= 0 {
+		s.broadcastQueue = defaultBroadcastQueue
+	}
+	if s.netpollEnabled {
+		np, err := newNetpoll(s)
+		if err != nil {
+			s.logger.Error("couldn't start netpoll, using default backend", "error", err)
+		}
+		s.netpoll = np
+	}
+	return s
+}
+
+// MetricsHandler returns an http.Handler serving the prometheus metrics of
+// the server, or nil if metrics are disabled.
+func (s *Server) MetricsHandler() http.Handler {
+	if s.metrics == nil {
+		return nil
+	}
+	return s.metrics.handler()
+}
+
+// ExpvarHandler returns an http.Handler serving the expvar counters of the
+// server, or nil if expvar is disabled.
+func (s *Server) ExpvarHandler() http.Handler {
+	if !s.expvar {
+		return nil
+	}
+	return s.vars.handler()
+}
+
+// mode is the way a connection is served.
+type mode int
+
+const (
+	modeEcho mode = iota
+	modeSink
+	modeStream
+	modeBroadcast
+	modeSockJS
+	modeSocketIO
+	modeSTOMP
+)
+
+// session is a websocket connection served by the default backend.
+type session struct {
+	ctx    context.Context
+	id     uint64
+	conn   wsConn
+	logger *slog.Logger
+	live   *liveness
+	stats  *connStats
+	params *params
+
+	// closeConn sends a close frame to the client and stops serving the
+	// connection.
+	closeConn func(code int, text string)
+
+	// finish ends the connection once its close limits are reached.
+	finish func()
+}
+
+// ConnIDHeader is the header of the upgrade response with the id of the
+// connection, as logged by the server, to correlate client and server logs.
+const ConnIDHeader = "X-WSEcho-Conn-ID"
+
+// connIDHeader returns the response headers with the id of the connection.
+func connIDHeader(id uint64) http.Header {
+	h := http.Header{}
+	h.Set(ConnIDHeader, strconv.FormatUint(id, 10))
+	return h
+}
+
+// ServeHTTP implements http.Handler.ServeHTTP
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serveMode(w, r, modeEcho)
+}
+
+// serveMode upgrades the connection and serves it in the mode.
+func (s *Server) serveMode(w http.ResponseWriter, r *http.Request, m mode) {
+	r = s.forwarded(r)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	start := time.Now()
+	id := s.lastID.Add(1)
+	logger := s.logger.With("conn", id, "remote_addr", r.RemoteAddr)
+
+	// Trace the connection as a continuation of the client trace.
+	ctx = propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer.Start(ctx, "wsecho.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("net.peer.addr", r.RemoteAddr),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.Int64("wsecho.conn", int64(id)),
+		),
+	)
+	defer span.End()
+
+	if err := s.tracker.refused(); err != nil {
+		spanError(span, err)
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn("connection refused", "error", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := s.checkAddr(r); err != nil {
+		spanError(span, err)
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn("connection refused", "error", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	claims, err := s.authorize(w, r)
+	if err != nil {
+		spanError(span, err)
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn("couldn't authorize", "error", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	p, err := s.connParams(r, id)
+	if err != nil {
+		spanError(span, err)
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn("invalid parameters", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hand plain connections over to the netpoll backend, which, like
+	// fragments mode, ignores the validated params.
+	if m == modeEcho && s.netpoll != nil && r.TLS == nil {
+		s.netpoll.serve(w, r, id, start, claims, logger)
+		return
+	}
+	if m == modeEcho && s.fragments {
+		s.serveFragments(w, r, id, start, claims, logger)
+		return
+	}
+
+	// Websocket connection
+	_, upgradeSpan := s.tracer.Start(ctx, "wsecho.upgrade")
+	var subprotocols []string
+	if m == modeSTOMP {
+		subprotocols = stompSubprotocols
+	}
+	conn, err := s.upgrade(w, r, id, subprotocols)
+	if err != nil {
+		spanError(upgradeSpan, err)
+		upgradeSpan.End()
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Error("couldn't upgrade", "error", err)
+		return
+	}
+	var connErr error
+	defer func() {
+		s.accessLog.log(r, id, start, conn.Subprotocol(), true, connErr)
+	}()
+	upgradeSpan.End()
+	s.metrics.connOpened()
+	defer s.metrics.connClosed()
+	s.vars.connOpened()
+	defer s.vars.connClosed()
+	defer func() {
+		// Aborted connections are already closed.
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("couldn't close", "error", err)
+		}
+	}()
+
+	if p := conn.Subprotocol(); p != "" {
+		logger.Info("subprotocol negotiated", "subprotocol", p)
+	}
+	if s.compression && hasCompression(r.Header) {
+		logger.Info("compression negotiated", "extension", "permessage-deflate")
+	}
+
+	// Log client certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		logger.Info("client certificate", "subject", r.TLS.PeerCertificates[0].Subject.String())
+	}
+
+	// Describe the upgrade request to the client.
+	info, err := s.handshakeMessage(r, conn.Subprotocol())
+	if err != nil {
+		logger.Error("couldn't encode handshake info", "error", err)
+		return
+	}
+	if info != nil {
+		if err := conn.WriteMessage(websocket.TextMessage, info); err != nil {
+			logger.Error("couldn't write handshake info", "error", err)
+			return
+		}
+	}
+
+	// Send the selected token claims back to the client.
+	if claims != nil {
+		greeting, err := s.jwt.greeting(claims)
+		if err != nil {
+			logger.Error("couldn't encode claims", "error", err)
+			return
+		}
+		if greeting != nil {
+			if err := conn.WriteMessage(websocket.TextMessage, greeting); err != nil {
+				logger.Error("couldn't write claims", "error", err)
+				return
+			}
+		}
+	}
+
+	if p.maxSize > 0 {
+		conn.SetReadLimit(p.maxSize)
+	}
+
+	// Ping pong handlers
+	conn.SetPingHandler(func(appData string) error {
+		// Send pong as a control message, which can be written while a
+		// message is being written.
+		logger.Debug("ping", "data", appData)
+		var deadline time.Time
+		if s.writeTimeout > 0 {
+			deadline = time.Now().Add(s.writeTimeout)
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), deadline)
+	})
+	live := &liveness{}
+	live.active()
+	conn.SetPongHandler(func(appData string) error {
+		logger.Debug("pong", "data", appData)
+		live.pong()
+		return nil
+	})
+
+	// closeConn sends a close frame to the client and stops serving the
+	// connection.
+	closeConn := func(code int, text string) {
+		cancel()
+		msg := websocket.FormatCloseMessage(code, text)
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	if s.keepaliveInterval > 0 || s.idleTimeout > 0 {
+		go s.keepalive(ctx, conn, live, logger, closeConn)
+	}
+	// finish ends the connection once its close limits are reached.
+	finish := func() {
+		if p.abort != "" {
+			cancel()
+			if err := abort(conn.UnderlyingConn(), p.abort); err != nil {
+				logger.Error("couldn't abort", "error", err)
+			}
+			return
+		}
+		closeConn(p.closeFrame())
+	}
+	tc := &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		uri:        r.URL.Path,
+		proto:      r.Proto,
+		start:      start,
+		goAway: func() {
+			logger.Info("going away")
+			cancel()
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, errShuttingDown.Error())
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		},
+		kill: func() {
+			_ = conn.UnderlyingConn().Close()
+		},
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			closeConn(code, reason)
+		},
+	}
+	defer s.tracker.add(tc)()
+	if p.closeAfterTime > 0 {
+		t := time.AfterFunc(p.closeAfterTime, func() {
+			logger.Info("closing after time", "after", p.closeAfterTime)
+			finish()
+		})
+		defer t.Stop()
+	}
+
+	// Close handler
+	conn.SetCloseHandler(func(code int, text string) error {
+		logger.Info("close", "code", code, "text", text)
+		// Reply with the same code to complete the close handshake.
+		msg := websocket.FormatCloseMessage(code, "")
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		span.AddEvent("close", trace.WithAttributes(
+			attribute.Int("websocket.close.code", code),
+			attribute.String("websocket.close.text", text),
+		))
+		cancel()
+		return nil
+	})
+
+	if p.closeNow() {
+		code, reason := p.closeFrame()
+		logger.Info("closing on request", "code", code, "reason", reason, "abort", p.abort)
+		finish()
+		return
+	}
+
+	c := &session{
+		ctx:       ctx,
+		id:        id,
+		conn:      conn,
+		logger:    logger,
+		live:      live,
+		stats:     &tc.stats,
+		params:    p,
+		closeConn: closeConn,
+		finish:    finish,
+	}
+	switch m {
+	case modeSink:
+		connErr = s.sink(c)
+	case modeStream:
+		connErr = s.generate(c)
+	case modeBroadcast:
+		connErr = s.broadcast(c)
+	case modeSockJS:
+		connErr = s.sockJSEcho(c)
+	case modeSocketIO:
+		connErr = s.socketIOEcho(c)
+	case modeSTOMP:
+		connErr = s.stompEcho(c)
+	default:
+		connErr = s.echoMessages(c)
+	}
+}
+
+// echoMessages echoes the messages of the connection until it is closed,
+// returning the error that ended it.
+func (s *Server) echoMessages(c *session) error {
+	ctx, conn, logger, p := c.ctx, c.conn, c.logger, c.params
+	var buf bytes.Buffer
+	var messages int
+	debug := logger.Enabled(ctx, slog.LevelDebug)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if p.closeAfter > 0 && messages >= p.closeAfter {
+			logger.Info("closing after messages", "messages", messages)
+			c.finish()
+			return nil
+		}
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return err
+			}
+		}
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		messages++
+		if p.readLimiter != nil {
+			r = &throttledReader{ctx: ctx, r: r, limiter: p.readLimiter}
+		}
+
+		// Stream messages unless they must be inspected as a whole.
+		if !s.buffered(mt) && !p.buffered() {
+			if p.dropped() {
+				n, err := io.Copy(io.Discard, r)
+				if err != nil {
+					return s.readError(ctx, logger, err)
+				}
+				if debug {
+					logger.Debug("dropped", "bytes", n)
+				}
+				c.live.active()
+				c.stats.received(int(n))
+				continue
+			}
+			if !p.wait(ctx) {
+				return nil
+			}
+			_, echoSpan := s.tracer.Start(ctx, "wsecho.echo", trace.WithAttributes(
+				attribute.Int("websocket.message.type", mt),
+			))
+			echoStart := time.Now()
+			if err := s.setWriteDeadline(conn); err != nil {
+				echoSpan.End()
+				logger.Error("couldn't set write deadline", "error", err)
+				return err
+			}
+			n, readErr, writeErr := stream(ctx, conn, mt, r, p.limiter)
+			echoSpan.SetAttributes(attribute.Int64("websocket.message.size", n))
+			if readErr != nil {
+				spanError(echoSpan, readErr)
+				echoSpan.End()
+				return s.readError(ctx, logger, readErr)
+			}
+			if writeErr != nil {
+				spanError(echoSpan, writeErr)
+				echoSpan.End()
+				return s.writeError(logger, writeErr)
+			}
+			echoSpan.End()
+			if debug {
+				logger.Debug("recv", "bytes", n)
+			}
+			c.live.active()
+			c.stats.received(int(n))
+			c.stats.sent(int(n))
+			s.metrics.echoed(int(n), time.Since(echoStart))
+			s.vars.echoed(int(n), time.Since(echoStart))
+			continue
+		}
+
+		// Reuse the read buffer across messages, nothing retains the message
+		// after it is echoed. Buffers grown by large messages are released.
+		if buf.Cap() > maxRetainedBuffer {
+			buf = bytes.Buffer{}
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(r); err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		message := buf.Bytes()
+		if debug {
+			logger.Debug("recv", "bytes", len(message))
+		}
+		c.live.active()
+		c.stats.received(len(message))
+		if s.invalidUTF8(mt, message) {
+			s.vars.failed()
+			logger.Warn("invalid UTF-8", "bytes", len(message))
+			c.closeConn(websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+			return errInvalidUTF8
+		}
+		s.capture.record(c.id, mt, message)
+		if s.previewSize > 0 {
+			logger.Info("preview", "type", mt, "bytes", len(message), "payload", preview(message, s.previewSize))
+		}
+		if s.hmacKey != nil {
+			payload, ok := verify(s.hmacKey, hmacRequest, mt, message)
+			if !ok {
+				s.vars.failed()
+				logger.Warn("invalid signature", "bytes", len(message))
+				c.closeConn(websocket.ClosePolicyViolation, "invalid signature")
+				return errInvalidSignature
+			}
+			message = sign(s.hmacKey, hmacEcho, mt, p.transform(mt, payload))
+		} else {
+			message = p.transform(mt, message)
+		}
+		if p.dropped() {
+			if debug {
+				logger.Debug("dropped", "bytes", len(message))
+			}
+			continue
+		}
+		if corrupted, ok := p.corrupted(message); ok {
+			if debug {
+				logger.Debug("corrupted", "bytes", len(message), "echo_bytes", len(corrupted))
+			}
+			message = corrupted
+		}
+		if !p.wait(ctx) {
+			return nil
+		}
+		if err := s.echo(c, mt, message); err != nil {
+			return s.writeError(logger, err)
+		}
+	}
+}
+
+// writeError logs an error writing to the client and returns it.
+func (s *Server) writeError(logger *slog.Logger, err error) error {
+	s.vars.failed()
+	logger.Error("couldn't write", "error", err)
+	return err
+}
+
+// echo writes the buffered message back to the client, as many times as the
+// params of the connection set.
+func (s *Server) echo(c *session, mt int, message []byte) error {
+	ctx, conn, p := c.ctx, c.conn, c.params
+	for i := 0; i < p.echoes(); i++ {
+		if i > 0 && !sleep(ctx, p.repeatInterval) {
+			return nil
+		}
+		_, span := s.tracer.Start(ctx, "wsecho.echo", trace.WithAttributes(
+			attribute.Int("websocket.message.type", mt),
+			attribute.Int("websocket.message.size", len(message)),
+		))
+		start := time.Now()
+		if err := s.setWriteDeadline(conn); err != nil {
+			span.End()
+			return fmt.Errorf("couldn't set write deadline: %w", err)
+		}
+		var err error
+		if p.limiter != nil {
+			_, _, err = stream(ctx, conn, mt, bytes.NewReader(message), p.limiter)
+		} else {
+			err = conn.WriteMessage(mt, message)
+		}
+		if err != nil {
+			spanError(span, err)
+			span.End()
+			return err
+		}
+		span.End()
+		s.metrics.echoed(len(message), time.Since(start))
+		s.vars.echoed(len(message), time.Since(start))
+		c.stats.sent(len(message))
+	}
+	return nil
+}
+
+// maxRetainedBuffer is the maximum capacity of the read buffer kept between
+// messages.
+const maxRetainedBuffer = 1 << 20
+
+// buffered returns true if messages of the type must be read as a whole
+// before echoing them.
+func (s *Server) buffered(messageType int) bool {
+	if messageType == websocket.TextMessage && s.validateUTF8() {
+		return true
+	}
+	return s.capture != nil || s.hmacKey != nil || s.previewSize > 0
+}
+
+// readError logs an error reading from the client and returns it, or nil if
+// it is caused by the connection being closed.
+func (s *Server) readError(ctx context.Context, logger *slog.Logger, err error) error {
+	// The server closed the connection.
+	if ctx.Err() != nil {
+		return nil
+	}
+	// Closed connections aren't errors of the server.
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		logger.Info("connection closed", "error", err)
+		return nil
+	}
+	// The websocket library already sent the 1009 close frame.
+	if errors.Is(err, websocket.ErrReadLimit) {
+		s.metrics.oversized()
+		s.vars.oversized()
+		logger.Warn("message too big", "limit", s.maxMessageSize)
+		return err
+	}
+	s.vars.failed()
+	logger.Error("couldn't read", "error", err)
+	return err
+}
+
+// setWriteDeadline sets the deadline of the next write if a write timeout
+// is configured.
+func (s *Server) setWriteDeadline(conn wsConn) error {
+	if s.writeTimeout <= 0 {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+}
+
+// hasCompression returns true if the Sec-WebSocket-Extensions header includes
+// permessage-deflate.
+func hasCompression(h http.Header) bool {
+	for _, v := range h.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// preview returns the first n bytes of data as text if they are valid UTF-8
+// or as space separated hex bytes otherwise.
+func preview(data []byte, n int) string {
+	suffix := ""
+	if len(data) > n {
+		data = data[:n]
+		suffix = "..."
+	}
+	if utf8.Valid(data) {
+		return string(data) + suffix
+	}
+	return fmt.Sprintf("% x", data) + suffix
+}
@@ -0,0 +1,100 @@
+package wsecho
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves an in-process server that doesn't log, closed when
+// the test ends, and returns its websocket URL.
+func newTestServer(tb testing.TB, opts ...Option) string {
+	opts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	srv := httptest.NewServer(NewServer(opts...))
+	tb.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// benchmarkEcho pings an in-process server with 1 KiB messages, reusing the
+// client buffers so the allocations reported are mostly the server ones.
+func benchmarkEcho(b *testing.B, messageType int, opts ...Option) {
+	conn, _, err := websocket.DefaultDialer.Dial(newTestServer(b, opts...), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	message := bytes.Repeat([]byte("a"), 1024)
+	var buf bytes.Buffer
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.WriteMessage(messageType, message); err != nil {
+			b.Fatal(err)
+		}
+		_, r, err := conn.NextReader()
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(r); err != nil {
+			b.Fatal(err)
+		}
+		if buf.Len() != len(message) {
+			b.Fatalf("got %d bytes, want %d", buf.Len(), len(message))
+		}
+	}
+}
+
+func BenchmarkEchoStreaming(b *testing.B) {
+	benchmarkEcho(b, websocket.BinaryMessage)
+}
+
+func BenchmarkEchoBuffered(b *testing.B) {
+	benchmarkEcho(b, websocket.TextMessage)
+}
+
+func TestUTF8Validation(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		messageType int
+		wantClose   bool
+	}{
+		{name: "text", messageType: websocket.TextMessage, wantClose: true},
+		{name: "binary", messageType: websocket.BinaryMessage},
+		{name: "disabled", opts: []Option{WithUTF8Validation(false)}, messageType: websocket.TextMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial(newTestServer(t, tt.opts...), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			invalid := []byte{'a', 0xff, 'b'}
+			if err := conn.WriteMessage(tt.messageType, invalid); err != nil {
+				t.Fatal(err)
+			}
+			mt, data, err := conn.ReadMessage()
+			if tt.wantClose {
+				if !websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData) {
+					t.Fatalf("got error %v, want close 1007", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != tt.messageType || !bytes.Equal(data, invalid) {
+				t.Errorf("got message %d %q, want %d %q", mt, data, tt.messageType, invalid)
+			}
+		})
+	}
+}
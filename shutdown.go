@@ -0,0 +1,195 @@
+package wsecho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// errShuttingDown is returned for upgrades received during shutdown.
+	errShuttingDown = errors.New("server shutting down")
+	// errDraining is returned for upgrades received while draining.
+	errDraining = errors.New("server draining")
+)
+
+// tracker keeps the live websocket connections of the server so they can be
+// drained or closed on shutdown.
+type tracker struct {
+	mu    sync.Mutex
+	conns map[uint64]*trackedConn
+	// idle is closed while there are no live connections, so Drain and
+	// Shutdown can wait for them at the same time.
+	idle     chan struct{}
+	draining bool
+	shutdown bool
+}
+
+// trackedConn is a live connection.
+type trackedConn struct {
+	id         uint64
+	remoteAddr string
+	uri        string
+	proto      string
+	start      time.Time
+	stats      connStats
+
+	// goAway sends a going away close frame to the client.
+	goAway func()
+	// kill closes the connection without waiting for the client.
+	kill func()
+	// close sends a close frame with the code and reason to the client.
+	close func(code int, reason string)
+}
+
+func newTracker() *tracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &tracker{conns: map[uint64]*trackedConn{}, idle: idle}
+}
+
+// add tracks the connection until the returned function is called, which
+// can be called more than once. Connections added once the server is
+// shutting down are sent a close frame right away.
+func (t *tracker) add(c *trackedConn) func() {
+	id := c.id
+	t.mu.Lock()
+	if len(t.conns) == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.conns[id] = c
+	shutdown := t.shutdown
+	t.mu.Unlock()
+	if shutdown {
+		c.goAway()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.conns, id)
+			if len(t.conns) == 0 {
+				close(t.idle)
+			}
+			t.mu.Unlock()
+		})
+	}
+}
+
+// refused returns the error upgrades are refused with, nil if they are
+// accepted.
+func (t *tracker) refused() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.shutdown:
+		return errShuttingDown
+	case t.draining:
+		return errDraining
+	}
+	return nil
+}
+
+// get returns the live connection with the id, or nil.
+func (t *tracker) get(id uint64) *trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conns[id]
+}
+
+// live returns the live connections.
+func (t *tracker) live() []*trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// wait waits for the live connections to end until the context is done,
+// returning the connections still live.
+func (t *tracker) wait(ctx context.Context) []*trackedConn {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+	return t.live()
+}
+
+// WithDrain drains the server when it receives any of the signals, waiting
+// up to timeout for the live connections to end, and then shuts it down.
+// The timeout is also the grace period of Drain, zero waits until the
+// connections end.
+func WithDrain(timeout time.Duration, signals ...os.Signal) Option {
+	return func(s *Server) {
+		s.drainTimeout = timeout
+		s.drainSignals = signals
+	}
+}
+
+// Drain stops accepting upgrades, refusing them with 503 (service
+// unavailable), and waits for the live websocket connections to end on
+// their own until the grace period set by WithDrain passes or the context
+// is done. The connections still live are then sent a 1001 (going away)
+// close frame and closed. It returns the number of connections closed
+// forcibly. The server keeps refusing upgrades once drained.
+func (s *Server) Drain(ctx context.Context) int {
+	t := s.tracker
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	if s.drainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.drainTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	s.logger.Info("draining", "conns", len(t.live()), "timeout", s.drainTimeout)
+	conns := t.wait(ctx)
+	for _, c := range conns {
+		c.goAway()
+		c.kill()
+	}
+	s.logger.Info("drained", "forced", len(conns), "duration", time.Since(start))
+	return len(conns)
+}
+
+// Shutdown sends a 1001 (going away) close frame to every live websocket
+// connection and waits for them to end until the context is done, then
+// closes the remaining connections. New upgrades are refused with 503
+// (service unavailable) once Shutdown is called. It returns an error with the
+// number of connections closed forcibly if the context is done first. The
+// netpoll backend is stopped once the connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	t := s.tracker
+	t.mu.Lock()
+	t.shutdown = true
+	t.mu.Unlock()
+	if s.netpoll != nil {
+		defer s.netpoll.stop()
+	}
+	conns := t.live()
+	s.logger.Info("closing connections", "conns", len(conns))
+	for _, c := range conns {
+		c.goAway()
+	}
+
+	conns = t.wait(ctx)
+	if len(conns) == 0 {
+		return nil
+	}
+	s.logger.Warn("closing connections forcibly", "conns", len(conns))
+	for _, c := range conns {
+		c.kill()
+	}
+	return fmt.Errorf("couldn't close %d connections gracefully: %w", len(conns), ctx.Err())
+}
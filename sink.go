@@ -0,0 +1,95 @@
+package wsecho
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SinkAck is the acknowledgement sent by the sink with the messages
+// received since the connection started.
+type SinkAck struct {
+	// Messages is the number of messages received.
+	Messages int64 `json:"messages"`
+	// Bytes is the number of payload bytes received.
+	Bytes int64 `json:"bytes"`
+}
+
+// WithSinkAck sends a SinkAck as a JSON text message to sink clients at most
+// once per interval, after a message is received. Clients can set the
+// interval of their connection with the ack query parameter, e.g. ?ack=1s.
+func WithSinkAck(interval time.Duration) Option {
+	return func(s *Server) {
+		s.params.ack = interval
+	}
+}
+
+// SinkHandler returns an http.Handler serving websocket connections whose
+// messages are read and discarded instead of echoed, to measure upload
+// throughput without the echo doubling the bandwidth.
+func (s *Server) SinkHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMode(w, r, modeSink)
+	})
+}
+
+// sink discards the messages of the connection until it is closed,
+// returning the error that ended it.
+func (s *Server) sink(c *session) error {
+	ctx, conn, logger := c.ctx, c.conn, c.logger
+	debug := logger.Enabled(ctx, slog.LevelDebug)
+	var ack SinkAck
+	lastAck := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return err
+			}
+		}
+		_, r, err := conn.NextReader()
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		if c.params.readLimiter != nil {
+			r = &throttledReader{ctx: ctx, r: r, limiter: c.params.readLimiter}
+		}
+		n, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		if debug {
+			logger.Debug("recv", "bytes", n)
+		}
+		c.live.active()
+		c.stats.received(int(n))
+		ack.Messages++
+		ack.Bytes += n
+
+		if c.params.ack <= 0 || time.Since(lastAck) < c.params.ack {
+			continue
+		}
+		lastAck = time.Now()
+		data, err := json.Marshal(ack)
+		if err != nil {
+			return err
+		}
+		if err := s.setWriteDeadline(conn); err != nil {
+			logger.Error("couldn't set write deadline", "error", err)
+			return err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return s.writeError(logger, err)
+		}
+		c.stats.sent(len(data))
+	}
+}
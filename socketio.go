@@ -0,0 +1,812 @@
+package wsecho
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Engine.IO packet types.
+const (
+	eioOpen    = '0'
+	eioClose   = '1'
+	eioPing    = '2'
+	eioPong    = '3'
+	eioMessage = '4'
+	eioUpgrade = '5'
+	eioNoop    = '6'
+)
+
+// Socket.IO packet types.
+const (
+	sioConnect      = '0'
+	sioDisconnect   = '1'
+	sioEvent        = '2'
+	sioAck          = '3'
+	sioConnectError = '4'
+	sioBinaryEvent  = '5'
+	sioBinaryAck    = '6'
+)
+
+const (
+	// eioPingInterval is the interval of the pings sent by the server.
+	eioPingInterval = 25 * time.Second
+	// eioPingTimeout is the time the client has to answer a ping before
+	// the session is closed.
+	eioPingTimeout = 20 * time.Second
+	// eioMaxPayload is the default maximum size of the payload of polling
+	// requests.
+	eioMaxPayload = 1000000
+	// eioSeparator separates the packets of polling payloads.
+	eioSeparator = '\x1e'
+	// sioMaxAttachments is the maximum number of binary attachments of a
+	// packet.
+	sioMaxAttachments = 64
+)
+
+// errEIOClosed is returned once the client closes the Engine.IO session.
+var errEIOClosed = errors.New("session closed by client")
+
+// SocketIOHandler returns an http.Handler serving a Socket.IO echo server
+// on /socket.io/ to Socket.IO v3 and v4 clients (Engine.IO protocol 4),
+// e.g. io("http://localhost:1337"). Sessions use either the websocket or the
+// polling transport, upgrades aren't offered. Clients connect to any
+// namespace and every event they emit is emitted back to them with the same
+// name and arguments, binary attachments included. Events emitted with an
+// acknowledgement are also acknowledged with their arguments.
+func (s *Server) SocketIOHandler() http.Handler {
+	return http.HandlerFunc(s.serveSocketIO)
+}
+
+func (s *Server) serveSocketIO(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("EIO") != "4" {
+		eioError(w, 5, "Unsupported protocol version")
+		return
+	}
+	switch q.Get("transport") {
+	case "websocket":
+		// Sessions can't be upgraded from polling since no upgrades are
+		// offered.
+		if q.Has("sid") {
+			eioError(w, 3, "Bad request")
+			return
+		}
+		s.serveMode(w, r, modeSocketIO)
+	case "polling":
+		if !s.allowCORS(w, r) {
+			return
+		}
+		switch r.Method {
+		case http.MethodOptions:
+			preflight(w, r)
+		case http.MethodGet:
+			if !q.Has("sid") {
+				s.eioHandshake(w, r)
+				return
+			}
+			s.eioPoll(w, r, q.Get("sid"))
+		case http.MethodPost:
+			s.eioSend(w, r, q.Get("sid"))
+		default:
+			eioError(w, 2, "Bad handshake method")
+		}
+	default:
+		eioError(w, 0, "Transport unknown")
+	}
+}
+
+// eioError answers the request with an Engine.IO error.
+func eioError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{code, message})
+}
+
+// eioID returns a random session id.
+func eioID() string {
+	b := make([]byte, 15)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// eioPacket is an Engine.IO packet. Binary packets are message packets.
+type eioPacket struct {
+	typ    byte
+	data   []byte
+	binary bool
+}
+
+// openPacket returns the open packet of a new session.
+func (s *Server) openPacket(sid string) (eioPacket, error) {
+	maxPayload := int64(eioMaxPayload)
+	if s.maxMessageSize > 0 {
+		maxPayload = s.maxMessageSize
+	}
+	data, err := json.Marshal(struct {
+		SID          string   `json:"sid"`
+		Upgrades     []string `json:"upgrades"`
+		PingInterval int64    `json:"pingInterval"`
+		PingTimeout  int64    `json:"pingTimeout"`
+		MaxPayload   int64    `json:"maxPayload"`
+	}{sid, []string{}, eioPingInterval.Milliseconds(), eioPingTimeout.Milliseconds(), maxPayload})
+	if err != nil {
+		return eioPacket{}, err
+	}
+	return eioPacket{typ: eioOpen, data: data}, nil
+}
+
+// sioPacket is a Socket.IO packet, carried by an Engine.IO message packet.
+type sioPacket struct {
+	typ         byte
+	attachments int
+	nsp         string
+	// id is the acknowledgement id, empty if none is requested.
+	id   string
+	data json.RawMessage
+}
+
+// parseSIOPacket parses the text encoding of a Socket.IO packet:
+// <type>[<attachments>-][<namespace>,][<id>][<data>].
+func parseSIOPacket(s string) (*sioPacket, error) {
+	if s == "" || s[0] < sioConnect || s[0] > sioBinaryAck {
+		return nil, fmt.Errorf("invalid packet type %q", s)
+	}
+	p := &sioPacket{typ: s[0], nsp: "/"}
+	s = s[1:]
+	if p.typ == sioBinaryEvent || p.typ == sioBinaryAck {
+		n, rest, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, errors.New("missing attachments")
+		}
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 0 || v > sioMaxAttachments {
+			return nil, fmt.Errorf("invalid attachments %q", n)
+		}
+		p.attachments, s = v, rest
+	}
+	if s != "" && s[0] == '/' {
+		nsp, rest, _ := strings.Cut(s, ",")
+		p.nsp, s = nsp, rest
+	}
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	p.id, s = s[:i], s[i:]
+	if s != "" {
+		if !json.Valid([]byte(s)) {
+			return nil, errors.New("invalid payload")
+		}
+		p.data = json.RawMessage(s)
+	}
+	return p, nil
+}
+
+// encode returns the text encoding of the packet.
+func (p *sioPacket) encode() []byte {
+	b := []byte{p.typ}
+	if p.typ == sioBinaryEvent || p.typ == sioBinaryAck {
+		b = strconv.AppendInt(b, int64(p.attachments), 10)
+		b = append(b, '-')
+	}
+	if p.nsp != "/" {
+		b = append(b, p.nsp...)
+		b = append(b, ',')
+	}
+	b = append(b, p.id...)
+	return append(b, p.data...)
+}
+
+// sioSocket is the Socket.IO echo state of an Engine.IO session, shared by
+// its transports.
+type sioSocket struct {
+	logger *slog.Logger
+	// lastPong is the time of the last pong, in nanoseconds since the epoch.
+	lastPong atomic.Int64
+
+	// mu serializes the packets of concurrent polling requests.
+	mu sync.Mutex
+	// namespaces are the namespaces the client is connected to.
+	namespaces map[string]bool
+	// binary is the binary packet waiting for its attachments.
+	binary      *sioPacket
+	attachments [][]byte
+}
+
+func newSIOSocket(logger *slog.Logger) *sioSocket {
+	k := &sioSocket{logger: logger, namespaces: map[string]bool{}}
+	k.lastPong.Store(time.Now().UnixNano())
+	return k
+}
+
+// timedOut returns true if the client hasn't answered the pings in time.
+func (k *sioSocket) timedOut() bool {
+	return time.Since(time.Unix(0, k.lastPong.Load())) > eioPingInterval+eioPingTimeout
+}
+
+// handle handles a packet received from the client, returning the packets
+// to send back and the number of bytes echoed.
+func (k *sioSocket) handle(p eioPacket) ([]eioPacket, int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case p.binary:
+		return k.attachment(p.data)
+	case p.typ == eioPing:
+		return []eioPacket{{typ: eioPong, data: p.data}}, 0, nil
+	case p.typ == eioPong:
+		k.lastPong.Store(time.Now().UnixNano())
+		return nil, 0, nil
+	case p.typ == eioClose:
+		return nil, 0, errEIOClosed
+	case p.typ == eioNoop:
+		return nil, 0, nil
+	case p.typ == eioMessage:
+		return k.message(string(p.data))
+	}
+	return nil, 0, fmt.Errorf("unexpected packet type %q", p.typ)
+}
+
+// message handles a Socket.IO packet.
+func (k *sioSocket) message(s string) ([]eioPacket, int, error) {
+	if k.binary != nil {
+		return nil, 0, errors.New("missing binary attachments")
+	}
+	p, err := parseSIOPacket(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch p.typ {
+	case sioConnect:
+		k.namespaces[p.nsp] = true
+		k.logger.Info("namespace connected", "namespace", p.nsp)
+		data, err := json.Marshal(struct {
+			SID string `json:"sid"`
+		}{eioID()})
+		if err != nil {
+			return nil, 0, err
+		}
+		reply := &sioPacket{typ: sioConnect, nsp: p.nsp, data: data}
+		return []eioPacket{{typ: eioMessage, data: reply.encode()}}, 0, nil
+	case sioDisconnect:
+		delete(k.namespaces, p.nsp)
+		k.logger.Info("namespace disconnected", "namespace", p.nsp)
+		return nil, 0, nil
+	case sioEvent, sioBinaryEvent, sioAck, sioBinaryAck:
+		if p.attachments > 0 {
+			k.binary = p
+			return nil, 0, nil
+		}
+		return k.event(p, nil)
+	}
+	return nil, 0, fmt.Errorf("unexpected packet type %q", p.typ)
+}
+
+// attachment handles a binary attachment of the pending binary packet.
+func (k *sioSocket) attachment(data []byte) ([]eioPacket, int, error) {
+	if k.binary == nil {
+		return nil, 0, errors.New("unexpected binary attachment")
+	}
+	k.attachments = append(k.attachments, bytes.Clone(data))
+	if len(k.attachments) < k.binary.attachments {
+		return nil, 0, nil
+	}
+	p, attachments := k.binary, k.attachments
+	k.binary, k.attachments = nil, nil
+	return k.event(p, attachments)
+}
+
+// event echoes an event back to the client, acknowledging it if requested.
+// Acknowledgements of the client are ignored.
+func (k *sioSocket) event(p *sioPacket, attachments [][]byte) ([]eioPacket, int, error) {
+	if p.typ == sioAck || p.typ == sioBinaryAck {
+		return nil, 0, nil
+	}
+	if !k.namespaces[p.nsp] {
+		k.logger.Warn("event on a namespace not connected", "namespace", p.nsp)
+		return nil, 0, nil
+	}
+	var args []json.RawMessage
+	if err := json.Unmarshal(p.data, &args); err != nil || len(args) == 0 {
+		return nil, 0, errors.New("invalid event")
+	}
+	var name string
+	if err := json.Unmarshal(args[0], &name); err != nil {
+		return nil, 0, errors.New("invalid event name")
+	}
+	n := len(p.data)
+	for _, a := range attachments {
+		n += len(a)
+	}
+	k.logger.Debug("event", "namespace", p.nsp, "event", name, "bytes", n)
+
+	packets := func(sp *sioPacket) []eioPacket {
+		out := []eioPacket{{typ: eioMessage, data: sp.encode()}}
+		for _, a := range attachments {
+			out = append(out, eioPacket{typ: eioMessage, data: a, binary: true})
+		}
+		return out
+	}
+	echo := &sioPacket{typ: p.typ, attachments: p.attachments, nsp: p.nsp, data: p.data}
+	out := packets(echo)
+	if p.id != "" {
+		data, err := json.Marshal(args[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		ack := &sioPacket{typ: sioAck, attachments: p.attachments, nsp: p.nsp, id: p.id, data: data}
+		if p.typ == sioBinaryEvent {
+			ack.typ = sioBinaryAck
+		}
+		out = append(out, packets(ack)...)
+	}
+	return out, n, nil
+}
+
+// socketIOEcho serves a Socket.IO session over a websocket connection until
+// it is closed.
+func (s *Server) socketIOEcho(c *session) error {
+	ctx, conn, logger := c.ctx, c.conn, c.logger
+	sock := newSIOSocket(logger)
+
+	// Pings are written by the heartbeat while echoes are written.
+	var mu sync.Mutex
+	write := func(packets ...eioPacket) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range packets {
+			mt, data := websocket.TextMessage, append([]byte{p.typ}, p.data...)
+			if p.binary {
+				mt, data = websocket.BinaryMessage, p.data
+			}
+			if err := s.setWriteDeadline(conn); err != nil {
+				return err
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return err
+			}
+			c.stats.sent(len(data))
+		}
+		return nil
+	}
+	open, err := s.openPacket(eioID())
+	if err != nil {
+		return err
+	}
+	if err := write(open); err != nil {
+		return s.writeError(logger, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(eioPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if sock.timedOut() {
+				logger.Info("closing connection", "reason", "ping timeout")
+				c.closeConn(websocket.CloseNormalClosure, "ping timeout")
+				return
+			}
+			if err := write(eioPacket{typ: eioPing}); err != nil {
+				logger.Error("couldn't send ping", "error", err)
+				return
+			}
+		}
+	}()
+
+	for {
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return err
+			}
+		}
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		start := time.Now()
+		c.live.active()
+		c.stats.received(len(data))
+		p := eioPacket{typ: eioMessage, data: data, binary: mt == websocket.BinaryMessage}
+		if !p.binary {
+			if len(data) == 0 {
+				err = errors.New("empty packet")
+			} else {
+				p.typ, p.data = data[0], data[1:]
+			}
+		}
+		var out []eioPacket
+		var n int
+		if err == nil {
+			out, n, err = sock.handle(p)
+		}
+		if errors.Is(err, errEIOClosed) {
+			logger.Info("connection closed", "error", err)
+			c.closeConn(websocket.CloseNormalClosure, "")
+			return nil
+		}
+		if err != nil {
+			s.vars.failed()
+			logger.Warn("invalid socket.io packet", "error", err)
+			c.closeConn(websocket.CloseProtocolError, err.Error())
+			return err
+		}
+		if err := write(out...); err != nil {
+			return s.writeError(logger, err)
+		}
+		if n > 0 {
+			s.metrics.echoed(n, time.Since(start))
+			s.vars.echoed(n, time.Since(start))
+		}
+	}
+}
+
+// eioSessions are the Engine.IO sessions of the polling transport by id.
+type eioSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*eioSession
+}
+
+func newEIOSessions() *eioSessions {
+	return &eioSessions{sessions: map[string]*eioSession{}}
+}
+
+func (e *eioSessions) get(sid string) *eioSession {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sessions[sid]
+}
+
+// eioSession is an Engine.IO session of the polling transport, spanning the
+// requests polling its packets and the requests sending packets.
+type eioSession struct {
+	sock   *sioSocket
+	tc     *trackedConn
+	logger *slog.Logger
+	// client is the address of the client that opened the session.
+	client netip.Addr
+	// done is closed once the session ends.
+	done chan struct{}
+
+	mu sync.Mutex
+	// queue are the packets waiting for a polling request.
+	queue []eioPacket
+	// ready is signalled when packets are queued.
+	ready chan struct{}
+	// polling is true while a request polls the packets.
+	polling bool
+	// closing is true once the close packet is queued.
+	closing bool
+	// end stops tracking the session, once.
+	end func()
+}
+
+// send queues the packets for the next polling request.
+func (es *eioSession) send(packets ...eioPacket) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.closing {
+		return
+	}
+	es.queue = append(es.queue, packets...)
+	for _, p := range packets {
+		if p.typ == eioClose && !p.binary {
+			es.closing = true
+		}
+	}
+	select {
+	case es.ready <- struct{}{}:
+	default:
+	}
+}
+
+// eioHandshake opens a polling session.
+func (s *Server) eioHandshake(w http.ResponseWriter, r *http.Request) {
+	r = s.forwarded(r)
+	start := time.Now()
+	id := s.lastID.Add(1)
+	logger := s.logger.With("conn", id, "remote_addr", r.RemoteAddr)
+	refuse := func(err error, status int, msg string) {
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn(msg, "error", err)
+		http.Error(w, http.StatusText(status), status)
+	}
+	if err := s.tracker.refused(); err != nil {
+		refuse(err, http.StatusServiceUnavailable, "connection refused")
+		return
+	}
+	if err := s.checkAddr(r); err != nil {
+		refuse(err, http.StatusForbidden, "connection refused")
+		return
+	}
+	if _, err := s.authorize(w, r); err != nil {
+		refuse(err, http.StatusUnauthorized, "couldn't authorize")
+		return
+	}
+
+	client, _ := parseRemoteAddr(r.RemoteAddr)
+	sid := eioID()
+	open, err := s.openPacket(sid)
+	if err != nil {
+		logger.Error("couldn't encode open packet", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es := &eioSession{
+		sock:   newSIOSocket(logger),
+		logger: logger,
+		client: client,
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}, 1),
+	}
+	es.tc = &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		uri:        r.URL.Path,
+		proto:      r.Proto,
+		start:      start,
+		goAway: func() {
+			logger.Info("going away")
+			es.send(eioPacket{typ: eioClose})
+		},
+		kill: func() {
+			es.end()
+		},
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			es.send(eioPacket{typ: eioClose})
+		},
+	}
+
+	// The session can be ended once it is published or tracked, waiting
+	// for it to be tracked to untrack it.
+	var untrack func()
+	tracked := make(chan struct{})
+	var once sync.Once
+	es.end = func() {
+		once.Do(func() {
+			s.eio.mu.Lock()
+			delete(s.eio.sessions, sid)
+			s.eio.mu.Unlock()
+			close(es.done)
+			<-tracked
+			untrack()
+			s.metrics.connClosed()
+			s.vars.connClosed()
+			s.accessLog.log(r, id, start, "", true, nil)
+			logger.Info("session closed")
+		})
+	}
+	s.eio.mu.Lock()
+	s.eio.sessions[sid] = es
+	s.eio.mu.Unlock()
+
+	s.metrics.connOpened()
+	s.vars.connOpened()
+	untrack = s.tracker.add(es.tc)
+	close(tracked)
+
+	// The server pings the client, which must answer before the next ping.
+	go func() {
+		ticker := time.NewTicker(eioPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-es.done:
+				return
+			case <-ticker.C:
+			}
+			if es.sock.timedOut() {
+				logger.Info("closing session", "reason", "ping timeout")
+				es.end()
+				return
+			}
+			es.send(eioPacket{typ: eioPing})
+		}
+	}()
+	logger.Info("session opened", "sid", sid)
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	_, _ = w.Write(append([]byte{open.typ}, open.data...))
+}
+
+// eioSession returns the polling session with the id. Every request of a
+// session is filtered and authorized, and must come from the client that
+// opened it. It returns nil if the session doesn't exist or can't be used.
+func (s *Server) eioSession(w http.ResponseWriter, r *http.Request, sid string) *eioSession {
+	r = s.forwarded(r)
+	logger := s.logger.With("remote_addr", r.RemoteAddr)
+	refuse := func(err error, status int, msg string) {
+		s.vars.failed()
+		logger.Warn(msg, "error", err)
+		http.Error(w, http.StatusText(status), status)
+	}
+	if err := s.checkAddr(r); err != nil {
+		refuse(err, http.StatusForbidden, "connection refused")
+		return nil
+	}
+	if _, err := s.authorize(w, r); err != nil {
+		refuse(err, http.StatusUnauthorized, "couldn't authorize")
+		return nil
+	}
+	es := s.eio.get(sid)
+	if es == nil {
+		eioError(w, 1, "Session ID unknown")
+		return nil
+	}
+	if client, _ := parseRemoteAddr(r.RemoteAddr); es.client != client {
+		logger.Warn("session of another client refused", "conn", es.tc.id)
+		eioError(w, 1, "Session ID unknown")
+		return nil
+	}
+	return es
+}
+
+// eioPoll answers a polling request with the queued packets, waiting for
+// them if there are none.
+func (s *Server) eioPoll(w http.ResponseWriter, r *http.Request, sid string) {
+	es := s.eioSession(w, r, sid)
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	if es.polling {
+		es.mu.Unlock()
+		// Overlapping polls close the session like Engine.IO servers do.
+		es.logger.Warn("overlapping polling requests")
+		eioError(w, 3, "Bad request")
+		es.end()
+		return
+	}
+	es.polling = true
+	es.mu.Unlock()
+	defer func() {
+		es.mu.Lock()
+		es.polling = false
+		es.mu.Unlock()
+	}()
+
+	var packets []eioPacket
+	for packets == nil {
+		es.mu.Lock()
+		packets, es.queue = es.queue, nil
+		closing := es.closing
+		es.mu.Unlock()
+		if packets != nil {
+			break
+		}
+		if closing {
+			packets = []eioPacket{{typ: eioClose}}
+			break
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-es.done:
+			packets = []eioPacket{{typ: eioClose}}
+		case <-es.ready:
+		}
+	}
+
+	var body []byte
+	closed := false
+	for i, p := range packets {
+		if i > 0 {
+			body = append(body, eioSeparator)
+		}
+		if p.binary {
+			body = append(body, 'b')
+			body = append(body, base64.StdEncoding.EncodeToString(p.data)...)
+			continue
+		}
+		body = append(body, p.typ)
+		body = append(body, p.data...)
+		closed = closed || p.typ == eioClose
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if _, err := w.Write(body); err != nil {
+		es.logger.Info("polling request closed", "error", err)
+		return
+	}
+	es.tc.stats.sent(len(body))
+	if closed {
+		es.end()
+	}
+}
+
+// eioSend handles the packets sent by the client.
+func (s *Server) eioSend(w http.ResponseWriter, r *http.Request, sid string) {
+	es := s.eioSession(w, r, sid)
+	if es == nil {
+		return
+	}
+	start := time.Now()
+	maxPayload := int64(eioMaxPayload)
+	if s.maxMessageSize > 0 {
+		maxPayload = s.maxMessageSize
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPayload+1))
+	if err != nil {
+		es.logger.Info("couldn't read polling payload", "error", err)
+		return
+	}
+	if int64(len(data)) > maxPayload {
+		s.metrics.oversized()
+		s.vars.oversized()
+		es.logger.Warn("message too big", "limit", maxPayload)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		es.end()
+		return
+	}
+	es.tc.stats.received(len(data))
+
+	n := 0
+	for _, raw := range bytes.Split(data, []byte{eioSeparator}) {
+		p := eioPacket{}
+		switch {
+		case len(raw) == 0:
+			err = errors.New("empty packet")
+		case raw[0] == 'b':
+			p.typ, p.binary = eioMessage, true
+			p.data, err = base64.StdEncoding.DecodeString(string(raw[1:]))
+		default:
+			p.typ, p.data = raw[0], raw[1:]
+		}
+		var out []eioPacket
+		var echoed int
+		if err == nil {
+			out, echoed, err = es.sock.handle(p)
+		}
+		if errors.Is(err, errEIOClosed) {
+			es.logger.Info("session closed by client")
+			es.end()
+			break
+		}
+		if err != nil {
+			s.vars.failed()
+			es.logger.Warn("invalid socket.io packet", "error", err)
+			eioError(w, 3, "Bad request")
+			es.end()
+			return
+		}
+		es.send(out...)
+		n += echoed
+	}
+	if n > 0 {
+		s.metrics.echoed(n, time.Since(start))
+		s.vars.echoed(n, time.Since(start))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	_, _ = io.WriteString(w, "ok")
+}
@@ -0,0 +1,122 @@
+package wsecho
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseSIOPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    *sioPacket
+		wantErr bool
+	}{
+		{
+			name: "connect",
+			s:    "0",
+			want: &sioPacket{typ: sioConnect, nsp: "/"},
+		},
+		{
+			name: "connect namespace",
+			s:    `0/chat,{"token":"a"}`,
+			want: &sioPacket{typ: sioConnect, nsp: "/chat", data: json.RawMessage(`{"token":"a"}`)},
+		},
+		{
+			name: "namespace without comma",
+			s:    "1/chat",
+			want: &sioPacket{typ: sioDisconnect, nsp: "/chat"},
+		},
+		{
+			name: "event",
+			s:    `2["hello",1]`,
+			want: &sioPacket{typ: sioEvent, nsp: "/", data: json.RawMessage(`["hello",1]`)},
+		},
+		{
+			name: "event with ack id",
+			s:    `2/chat,42["hello"]`,
+			want: &sioPacket{typ: sioEvent, nsp: "/chat", id: "42", data: json.RawMessage(`["hello"]`)},
+		},
+		{
+			name: "ack",
+			s:    `312["ok"]`,
+			want: &sioPacket{typ: sioAck, nsp: "/", id: "12", data: json.RawMessage(`["ok"]`)},
+		},
+		{
+			name: "binary event with placeholder",
+			s:    `51-["file",{"_placeholder":true,"num":0}]`,
+			want: &sioPacket{
+				typ:         sioBinaryEvent,
+				attachments: 1,
+				nsp:         "/",
+				data:        json.RawMessage(`["file",{"_placeholder":true,"num":0}]`),
+			},
+		},
+		{
+			name: "binary ack",
+			s:    `62-/chat,7[{"_placeholder":true,"num":0},{"_placeholder":true,"num":1}]`,
+			want: &sioPacket{
+				typ:         sioBinaryAck,
+				attachments: 2,
+				nsp:         "/chat",
+				id:          "7",
+				data:        json.RawMessage(`[{"_placeholder":true,"num":0},{"_placeholder":true,"num":1}]`),
+			},
+		},
+		{
+			name:    "empty",
+			s:       "",
+			wantErr: true,
+		},
+		{
+			name:    "invalid type",
+			s:       `7["a"]`,
+			wantErr: true,
+		},
+		{
+			name:    "missing attachments",
+			s:       `5["a"]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid attachments",
+			s:       `5x-["a"]`,
+			wantErr: true,
+		},
+		{
+			name:    "negative attachments",
+			s:       `5-1-["a"]`,
+			wantErr: true,
+		},
+		{
+			name:    "too many attachments",
+			s:       `565-["a"]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid payload",
+			s:       `2["a"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseSIOPacket(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(p, tt.want) {
+				t.Errorf("got packet %+v, want %+v", p, tt.want)
+			}
+			if p == nil {
+				return
+			}
+			// Encoded packets parse back to the same packet.
+			got, err := parseSIOPacket(string(p.encode()))
+			if err != nil || !reflect.DeepEqual(got, p) {
+				t.Errorf("got encoded packet %+v with %v, want %+v", got, err, p)
+			}
+		})
+	}
+}
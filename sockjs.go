@@ -0,0 +1,569 @@
+package wsecho
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sockJSHeartbeat is the interval of the heartbeat frames sent to idle
+	// receiving requests.
+	sockJSHeartbeat = 25 * time.Second
+	// sockJSDisconnectDelay is the time a session is kept without a
+	// receiving request before it is closed.
+	sockJSDisconnectDelay = 5 * time.Second
+	// sockJSStreamingLimit is the number of bytes sent on an xhr-streaming
+	// response before it is closed, for the client to open a new one and
+	// free the memory the browser keeps for the response.
+	sockJSStreamingLimit = 128 << 10
+)
+
+// sockJSPrelude is written before the frames of xhr-streaming responses to
+// get past the buffering of some browsers.
+var sockJSPrelude = append(bytes.Repeat([]byte("h"), 2048), '\n')
+
+// SockJSHandler returns an http.Handler serving the echo service to SockJS
+// clients on /sockjs, e.g. new SockJS("http://localhost:1337/sockjs"), with
+// the websocket, xhr-streaming and xhr-polling transports. Raw websockets
+// are echoed on /sockjs/websocket. The messages of xhr sessions are echoed
+// as is, without the params of websocket connections.
+func (s *Server) SockJSHandler() http.Handler {
+	return http.HandlerFunc(s.serveSockJS)
+}
+
+func (s *Server) serveSockJS(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/sockjs")
+	switch path {
+	case "", "/":
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		_, _ = io.WriteString(w, "Welcome to SockJS!\n")
+		return
+	case "/info":
+		s.serveSockJSInfo(w, r)
+		return
+	case "/websocket":
+		s.serveMode(w, r, modeEcho)
+		return
+	}
+
+	// Session requests are /sockjs/{server}/{session}/{transport}.
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 3 || !validSockJSPart(parts[0]) || !validSockJSPart(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	key, transport := parts[0]+"/"+parts[1], parts[2]
+	switch transport {
+	case "websocket":
+		s.serveMode(w, r, modeSockJS)
+	case "xhr", "xhr_streaming", "xhr_send":
+		if !s.allowCORS(w, r) {
+			return
+		}
+		if r.Method == http.MethodOptions {
+			preflight(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if transport == "xhr_send" {
+			s.sockJSSend(w, r, key)
+			return
+		}
+		s.sockJSReceive(w, r, key, transport == "xhr_streaming")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// validSockJSPart returns true if the server or session part of a session
+// URL is valid.
+func validSockJSPart(p string) bool {
+	return p != "" && !strings.Contains(p, ".")
+}
+
+// serveSockJSInfo serves the info of the server requested by clients before
+// choosing a transport.
+func (s *Server) serveSockJSInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.allowCORS(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		preflight(w, r)
+	case http.MethodGet:
+		writeJSON(w, struct {
+			Websocket    bool     `json:"websocket"`
+			CookieNeeded bool     `json:"cookie_needed"`
+			Origins      []string `json:"origins"`
+			Entropy      uint32   `json:"entropy"`
+		}{Websocket: true, Origins: []string{"*:*"}, Entropy: rand.Uint32()})
+	default:
+		w.Header().Set("Allow", "OPTIONS, GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// allowCORS sets the CORS and caching headers of the response, returning
+// false after refusing the request if its origin isn't allowed.
+func (s *Server) allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	if !s.checkOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store, no-cache, no-transform, must-revalidate, max-age=0")
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Credentials", "true")
+	h.Add("Vary", "Origin")
+	return true
+}
+
+// preflight answers a CORS preflight request.
+func preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST")
+	if v := r.Header.Get("Access-Control-Request-Headers"); v != "" {
+		h.Set("Access-Control-Allow-Headers", v)
+	}
+	h.Set("Access-Control-Max-Age", "31536000")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sockJSFrame returns the frame with the messages, a JSON array of strings.
+func sockJSFrame(messages []string) ([]byte, error) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("a"), data...), nil
+}
+
+// sockJSCloseFrame returns the close frame with the code and reason.
+func sockJSCloseFrame(code int, reason string) []byte {
+	data, _ := json.Marshal([]any{code, reason})
+	return append([]byte("c"), data...)
+}
+
+var (
+	errSockJSPayload  = errors.New("payload expected")
+	errSockJSEncoding = errors.New("broken JSON encoding")
+)
+
+// parseSockJSMessages parses the messages sent by the client, a JSON array
+// of strings or a single string.
+func parseSockJSMessages(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errSockJSPayload
+	}
+	var messages []string
+	if data[0] != '[' {
+		var m string
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, errSockJSEncoding
+		}
+		return []string{m}, nil
+	}
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, errSockJSEncoding
+	}
+	return messages, nil
+}
+
+// sockJSEcho echoes the messages of a SockJS websocket connection, framed
+// as SockJS frames, until it is closed.
+func (s *Server) sockJSEcho(c *session) error {
+	ctx, conn, logger := c.ctx, c.conn, c.logger
+	if err := s.setWriteDeadline(conn); err != nil {
+		logger.Error("couldn't set write deadline", "error", err)
+		return err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("o")); err != nil {
+		return s.writeError(logger, err)
+	}
+	for {
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return err
+			}
+		}
+		_, r, err := conn.NextReader()
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		start := time.Now()
+		c.live.active()
+		c.stats.received(len(data))
+		messages, err := parseSockJSMessages(data)
+		if err != nil {
+			// Broken messages close the session like SockJS servers do.
+			s.vars.failed()
+			logger.Warn("invalid sockjs message", "error", err)
+			c.closeConn(websocket.CloseUnsupportedData, err.Error())
+			return err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		frame, err := sockJSFrame(messages)
+		if err != nil {
+			return err
+		}
+		if err := s.setWriteDeadline(conn); err != nil {
+			logger.Error("couldn't set write deadline", "error", err)
+			return err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+			return s.writeError(logger, err)
+		}
+		c.stats.sent(len(frame))
+		for _, m := range messages {
+			s.metrics.echoed(len(m), time.Since(start))
+			s.vars.echoed(len(m), time.Since(start))
+		}
+	}
+}
+
+// sockJSSessions are the sessions of the xhr transports by server and
+// session id.
+type sockJSSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*sockJSSession
+}
+
+func newSockJSSessions() *sockJSSessions {
+	return &sockJSSessions{sessions: map[string]*sockJSSession{}}
+}
+
+// sockJSSession is a session of the xhr transports, spanning the receiving
+// requests polling or streaming its frames and the requests sending
+// messages.
+type sockJSSession struct {
+	// client is the address of the client that created the session.
+	client netip.Addr
+	tc     *trackedConn
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// queue are the messages waiting for a receiving request.
+	queue []string
+	// ready is signalled when messages are queued or the session closes.
+	ready chan struct{}
+	// receiving is true while a request receives the frames.
+	receiving bool
+	// opened is true once the open frame is sent.
+	opened bool
+	// closeFrame is set once the session is closed.
+	closeFrame []byte
+	// expire ends the session once no request receives its frames for the
+	// disconnect delay.
+	expire *time.Timer
+	// end stops tracking the session, once.
+	end func()
+}
+
+// signal wakes up the receiving request.
+func (ss *sockJSSession) signal() {
+	select {
+	case ss.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close closes the session with the code and reason, sent to the next
+// receiving request.
+func (ss *sockJSSession) close(code int, reason string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closeFrame == nil {
+		ss.closeFrame = sockJSCloseFrame(code, reason)
+	}
+	ss.signal()
+}
+
+// sockJSSession returns the session with the key, creating it for receiving
+// requests if it doesn't exist. Every request of a session is filtered and
+// authorized, and must come from the client that created it. It returns nil
+// if the session doesn't exist or can't be used.
+func (s *Server) sockJSSession(w http.ResponseWriter, r *http.Request, key string, create bool) *sockJSSession {
+	r = s.forwarded(r)
+	start := time.Now()
+	id := uint64(0)
+	logger := s.logger.With("remote_addr", r.RemoteAddr)
+	refuse := func(err error, status int, msg string) {
+		s.vars.failed()
+		if id != 0 {
+			s.metrics.upgradeFailed()
+			s.accessLog.log(r, id, start, "", false, err)
+		}
+		logger.Warn(msg, "error", err)
+		http.Error(w, http.StatusText(status), status)
+	}
+	if err := s.checkAddr(r); err != nil {
+		refuse(err, http.StatusForbidden, "connection refused")
+		return nil
+	}
+	if _, err := s.authorize(w, r); err != nil {
+		refuse(err, http.StatusUnauthorized, "couldn't authorize")
+		return nil
+	}
+	client, _ := parseRemoteAddr(r.RemoteAddr)
+	existing := func(ss *sockJSSession) *sockJSSession {
+		if ss.client != client {
+			logger.Warn("session of another client refused", "conn", ss.tc.id)
+			http.NotFound(w, r)
+			return nil
+		}
+		return ss
+	}
+
+	s.sockJS.mu.Lock()
+	ss := s.sockJS.sessions[key]
+	s.sockJS.mu.Unlock()
+	if ss != nil {
+		return existing(ss)
+	}
+	if !create {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	id = s.lastID.Add(1)
+	logger = s.logger.With("conn", id, "remote_addr", r.RemoteAddr)
+	if err := s.tracker.refused(); err != nil {
+		refuse(err, http.StatusServiceUnavailable, "connection refused")
+		return nil
+	}
+
+	ss = &sockJSSession{client: client, logger: logger, ready: make(chan struct{}, 1)}
+	ss.tc = &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		// The session key would let anyone read or write the session.
+		uri:   "/sockjs/" + path.Base(r.URL.Path),
+		proto: r.Proto,
+		start: start,
+		goAway: func() {
+			logger.Info("going away")
+			ss.close(3000, "Go away!")
+		},
+		kill: func() {
+			ss.close(3000, "Go away!")
+			ss.end()
+		},
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			ss.close(code, reason)
+		},
+	}
+
+	// The session can be ended once it is published or tracked, waiting
+	// for it to be tracked to untrack it.
+	var untrack func()
+	tracked := make(chan struct{})
+	var once sync.Once
+	ss.end = func() {
+		once.Do(func() {
+			s.sockJS.mu.Lock()
+			delete(s.sockJS.sessions, key)
+			s.sockJS.mu.Unlock()
+			ss.mu.Lock()
+			if ss.expire != nil {
+				ss.expire.Stop()
+			}
+			ss.mu.Unlock()
+			<-tracked
+			untrack()
+			s.metrics.connClosed()
+			s.vars.connClosed()
+			s.accessLog.log(r, id, start, "", true, nil)
+			logger.Info("session closed")
+		})
+	}
+	s.sockJS.mu.Lock()
+	if other := s.sockJS.sessions[key]; other != nil {
+		// Another request created the session first.
+		s.sockJS.mu.Unlock()
+		return existing(other)
+	}
+	s.sockJS.sessions[key] = ss
+	s.sockJS.mu.Unlock()
+
+	s.metrics.connOpened()
+	s.vars.connOpened()
+	untrack = s.tracker.add(ss.tc)
+	close(tracked)
+	logger.Info("session opened")
+	return ss
+}
+
+// sockJSReceive serves a receiving request of the session, polling a single
+// frame or streaming frames until the streaming limit.
+func (s *Server) sockJSReceive(w http.ResponseWriter, r *http.Request, key string, streaming bool) {
+	ss := s.sockJSSession(w, r, key, true)
+	if ss == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript; charset=UTF-8")
+	rc := http.NewResponseController(w)
+	if streaming {
+		if _, err := w.Write(sockJSPrelude); err != nil {
+			return
+		}
+	}
+
+	ss.mu.Lock()
+	if ss.receiving {
+		ss.mu.Unlock()
+		_, _ = w.Write(append(sockJSCloseFrame(2010, "Another connection still open"), '\n'))
+		return
+	}
+	ss.receiving = true
+	if ss.expire != nil {
+		ss.expire.Stop()
+	}
+	ss.mu.Unlock()
+
+	// The session expires once no request receives it for the disconnect
+	// delay, or right after its close frame is sent.
+	defer func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		ss.receiving = false
+		if ss.closeFrame != nil && ss.queue == nil {
+			go ss.end()
+			return
+		}
+		ss.expire = time.AfterFunc(sockJSDisconnectDelay, ss.end)
+	}()
+
+	written := 0
+	heartbeat := time.NewTimer(sockJSHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		// Send the open frame, the queued messages, the close frame or a
+		// heartbeat, whichever comes first.
+		var frame []byte
+		ss.mu.Lock()
+		switch {
+		case !ss.opened:
+			ss.opened = true
+			frame = []byte("o")
+		case len(ss.queue) > 0:
+			var err error
+			frame, err = sockJSFrame(ss.queue)
+			if err != nil {
+				ss.mu.Unlock()
+				ss.logger.Error("couldn't encode sockjs frame", "error", err)
+				return
+			}
+			ss.queue = nil
+		case ss.closeFrame != nil:
+			frame = ss.closeFrame
+		}
+		ss.mu.Unlock()
+		if frame == nil {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ss.ready:
+				continue
+			case <-heartbeat.C:
+				frame = []byte("h")
+			}
+		}
+		heartbeat.Reset(sockJSHeartbeat)
+		n, err := w.Write(append(frame, '\n'))
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			ss.logger.Info("receiving request closed", "error", err)
+			return
+		}
+		if frame[0] == 'a' {
+			ss.tc.stats.sent(n)
+		}
+		written += n
+		if !streaming || frame[0] == 'c' || written >= sockJSStreamingLimit {
+			return
+		}
+	}
+}
+
+// sockJSSend echoes the messages sent to the session.
+func (s *Server) sockJSSend(w http.ResponseWriter, r *http.Request, key string) {
+	ss := s.sockJSSession(w, r, key, false)
+	if ss == nil {
+		return
+	}
+	start := time.Now()
+	var body io.Reader = r.Body
+	if s.maxMessageSize > 0 {
+		body = io.LimitReader(r.Body, s.maxMessageSize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		ss.logger.Info("couldn't read sockjs message", "error", err)
+		return
+	}
+	if s.maxMessageSize > 0 && int64(len(data)) > s.maxMessageSize {
+		s.metrics.oversized()
+		s.vars.oversized()
+		ss.logger.Warn("message too big", "limit", s.maxMessageSize)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	messages, err := parseSockJSMessages(data)
+	if err != nil {
+		s.vars.failed()
+		ss.logger.Warn("invalid sockjs message", "error", err)
+		// SockJS clients expect these exact bodies.
+		msg := "Broken JSON encoding."
+		if errors.Is(err, errSockJSPayload) {
+			msg = "Payload expected."
+		}
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	ss.tc.stats.received(len(data))
+
+	ss.mu.Lock()
+	if ss.closeFrame == nil {
+		ss.queue = append(ss.queue, messages...)
+		ss.signal()
+	}
+	ss.mu.Unlock()
+	for _, m := range messages {
+		s.metrics.echoed(len(m), time.Since(start))
+		s.vars.echoed(len(m), time.Since(start))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusNoContent)
+}
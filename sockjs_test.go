@@ -0,0 +1,83 @@
+package wsecho
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSockJSMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+		err  error
+	}{
+		{
+			name: "array",
+			data: `["a","b"]`,
+			want: []string{"a", "b"},
+		},
+		{
+			name: "single string",
+			data: `"a"`,
+			want: []string{"a"},
+		},
+		{
+			name: "whitespace",
+			data: " \n[\"a\"]\n",
+			want: []string{"a"},
+		},
+		{
+			name: "empty array",
+			data: `[]`,
+			want: []string{},
+		},
+		{
+			name: "escaped",
+			data: `["\"quoted\"\n","é😀"]`,
+			want: []string{"\"quoted\"\n", "é😀"},
+		},
+		{
+			name: "empty",
+			data: "",
+			err:  errSockJSPayload,
+		},
+		{
+			name: "only whitespace",
+			data: " \n",
+			err:  errSockJSPayload,
+		},
+		{
+			name: "broken array",
+			data: `["a"`,
+			err:  errSockJSEncoding,
+		},
+		{
+			name: "non string messages",
+			data: `[1,2]`,
+			err:  errSockJSEncoding,
+		},
+		{
+			name: "object",
+			data: `{"a":"b"}`,
+			err:  errSockJSEncoding,
+		},
+		{
+			name: "unquoted",
+			data: `a`,
+			err:  errSockJSEncoding,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSockJSMessages([]byte(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got messages %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package wsecho
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// sseEvent is the data of the events sent by the SSE handler.
+type sseEvent struct {
+	// Seq is the sequence number of the event, also sent as its id.
+	Seq int `json:"seq"`
+	// Time is the time the event was sent in nanoseconds since the epoch,
+	// to measure the delivery latency.
+	Time int64 `json:"time"`
+	// Payload is the generated payload, base64 encoded unless it is text.
+	Payload any `json:"payload"`
+}
+
+// SSEHandler returns an http.Handler streaming Server-Sent Events to the
+// client, to compare their delivery latency with the websocket one through
+// the same proxies. Events are generated like the messages of the stream
+// handler, with the size, rate, payload and count query parameters, e.g.
+// /sse?rate=10, but text payloads unless the payload query parameter is
+// set. Each event is a JSON object with its sequence number, the time it was
+// sent and the payload. Clients reconnecting with the Last-Event-ID header
+// resume after that event. The response ends once the count of events is
+// sent.
+func (s *Server) SSEHandler() http.Handler {
+	return http.HandlerFunc(s.serveSSE)
+}
+
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request) {
+	r = s.forwarded(r)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	start := time.Now()
+	id := s.lastID.Add(1)
+	logger := s.logger.With("conn", id, "remote_addr", r.RemoteAddr)
+
+	ctx = propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer.Start(ctx, "wsecho.sse",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("net.peer.addr", r.RemoteAddr),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.Int64("wsecho.conn", int64(id)),
+		),
+	)
+	defer span.End()
+
+	refuse := func(err error, status int, msg string) {
+		spanError(span, err)
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn(msg, "error", err)
+		http.Error(w, http.StatusText(status), status)
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		refuse(fmt.Errorf("invalid method %s", r.Method), http.StatusMethodNotAllowed, "invalid request")
+		return
+	}
+	if err := s.tracker.refused(); err != nil {
+		refuse(err, http.StatusServiceUnavailable, "connection refused")
+		return
+	}
+	if !s.checkOrigin(r) {
+		refuse(errors.New("origin not allowed"), http.StatusForbidden, "connection refused")
+		return
+	}
+	if err := s.checkAddr(r); err != nil {
+		refuse(err, http.StatusForbidden, "connection refused")
+		return
+	}
+	if _, err := s.authorize(w, r); err != nil {
+		refuse(err, http.StatusUnauthorized, "couldn't authorize")
+		return
+	}
+	p, err := s.connParams(r, id)
+	if err != nil {
+		spanError(span, err)
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn("invalid parameters", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	first := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			refuse(fmt.Errorf("invalid last event id %q", v), http.StatusBadRequest, "invalid request")
+			return
+		}
+		first = n + 1
+	}
+
+	var connErr error
+	defer func() {
+		s.accessLog.log(r, id, start, "", true, connErr)
+	}()
+	s.metrics.connOpened()
+	defer s.metrics.connClosed()
+	s.vars.connOpened()
+	defer s.vars.connClosed()
+
+	tc := &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		uri:        r.URL.Path,
+		proto:      r.Proto,
+		start:      start,
+		goAway: func() {
+			logger.Info("going away")
+			cancel()
+		},
+		kill: cancel,
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			cancel()
+		},
+	}
+	defer s.tracker.add(tc)()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Ask nginx not to buffer the events.
+	h.Set("X-Accel-Buffering", "no")
+	h.Set(ConnIDHeader, strconv.FormatUint(id, 10))
+	if origin := r.Header.Get("Origin"); origin != "" {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		connErr = err
+		logger.Error("couldn't flush", "error", err)
+		return
+	}
+
+	size := p.streamSize
+	if size <= 0 {
+		size = defaultStreamSize
+	}
+	// Events are text, binary payloads must be asked for explicitly.
+	typ := PayloadText
+	if r.URL.Query().Has("payload") {
+		typ = p.streamPayload
+	}
+	gen := newPayloadGenerator(typ, size, p.rand.Int63())
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if p.streamRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(p.streamRate), 1)
+	}
+	var buf []byte
+	for seq := first; p.streamCount <= 0 || seq < p.streamCount; seq++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return
+		}
+		if s.writeTimeout > 0 {
+			if err := rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				logger.Error("couldn't set write deadline", "error", err)
+				connErr = err
+				return
+			}
+		}
+		payload := gen.next(seq)
+		e := sseEvent{Seq: seq, Time: time.Now().UnixNano(), Payload: payload}
+		if typ == PayloadText {
+			e.Payload = string(payload)
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			connErr = err
+			logger.Error("couldn't encode event", "error", err)
+			return
+		}
+		buf = append(buf[:0], "id: "...)
+		buf = strconv.AppendInt(buf, int64(seq), 10)
+		buf = append(buf, "\ndata: "...)
+		buf = append(buf, data...)
+		buf = append(buf, "\n\n"...)
+		_, err = w.Write(buf)
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				connErr = err
+				logger.Info("connection closed", "error", err)
+			}
+			return
+		}
+		tc.stats.sent(len(payload))
+	}
+	logger.Info("stream done", "count", p.streamCount)
+}
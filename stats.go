@@ -0,0 +1,65 @@
+package wsecho
+
+import (
+	"net/http"
+	"time"
+)
+
+// WithStats enables serving the statistics of the server and its live
+// connections in JSON format, served by StatsHandler.
+func WithStats(enabled bool) Option {
+	return func(s *Server) {
+		s.stats = enabled
+	}
+}
+
+// Stats contains the statistics of a server, so test harnesses can check
+// what the server observed.
+// Durations are encoded to JSON as nanoseconds.
+type Stats struct {
+	// Started is the time the server started.
+	Started time.Time `json:"started"`
+	// Uptime is the time since the server started.
+	Uptime time.Duration `json:"uptime"`
+	// Connections is the number of connections upgraded.
+	Connections int64 `json:"connections"`
+	// ActiveConnections is the number of live connections.
+	ActiveConnections int `json:"active_connections"`
+	// Messages is the number of messages echoed or sent to clients.
+	Messages int64 `json:"messages"`
+	// Bytes is the number of payload bytes echoed or sent to clients.
+	Bytes int64 `json:"bytes"`
+	// Errors is the number of failed upgrades, reads and writes.
+	Errors int64 `json:"errors"`
+	// OversizedMessages is the number of messages over the maximum size.
+	OversizedMessages int64 `json:"oversized_messages"`
+	// Conns describes the live connections.
+	Conns []ConnInfo `json:"conns"`
+}
+
+// Stats returns the statistics of the server.
+func (s *Server) Stats() Stats {
+	conns := s.Connections()
+	return Stats{
+		Started:           s.started,
+		Uptime:            time.Since(s.started),
+		Connections:       s.vars.connections.Value(),
+		ActiveConnections: len(conns),
+		Messages:          s.vars.messages.Value(),
+		Bytes:             s.vars.bytes.Value(),
+		Errors:            s.vars.errors.Value(),
+		OversizedMessages: s.vars.oversizedMessages.Value(),
+		Conns:             conns,
+	}
+}
+
+// StatsHandler returns an http.Handler serving the Stats of the server in
+// JSON format, or nil if stats are disabled.
+func (s *Server) StatsHandler() http.Handler {
+	if !s.stats {
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Stats())
+	})
+}
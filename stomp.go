@@ -0,0 +1,425 @@
+package wsecho
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stompSubprotocols are the STOMP subprotocols negotiated by the STOMP
+// handler, in order of preference.
+var stompSubprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// stompVersions are the supported STOMP versions, in order of preference.
+var stompVersions = []string{"1.2", "1.1", "1.0"}
+
+// errSTOMPDisconnected is returned once the client sends a DISCONNECT frame.
+var errSTOMPDisconnected = errors.New("disconnected by client")
+
+// STOMPHandler returns an http.Handler speaking minimal STOMP 1.0, 1.1 and
+// 1.2 over websockets, for message broker clients to test their
+// connectivity against the server, e.g. ws://localhost:1337/stomp. The
+// server acts as a broker only visible to the connection: frames sent to a
+// destination are delivered back as MESSAGE frames to each subscription of
+// the connection to that destination, with the same headers and body.
+// Receipts and transactions are supported, acknowledgements are accepted and
+// ignored. The server doesn't send heartbeats.
+func (s *Server) STOMPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMode(w, r, modeSTOMP)
+	})
+}
+
+// stompFrame is a STOMP frame.
+type stompFrame struct {
+	command string
+	// headers are the headers in the order they are sent.
+	headers [][2]string
+	body    []byte
+}
+
+// header returns the first value of the header.
+func (f *stompFrame) header(key string) (string, bool) {
+	for _, h := range f.headers {
+		if h[0] == key {
+			return h[1], true
+		}
+	}
+	return "", false
+}
+
+// set appends the header to the frame.
+func (f *stompFrame) set(key, value string) *stompFrame {
+	f.headers = append(f.headers, [2]string{key, value})
+	return f
+}
+
+// stompEscaper and stompUnescaper escape header keys and values since STOMP
+// 1.1, except on CONNECT and CONNECTED frames.
+var (
+	stompEscaper   = strings.NewReplacer("\\", `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, "\\", `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+// encode returns the wire format of the frame.
+func (f *stompFrame) encode(escape bool) []byte {
+	var b bytes.Buffer
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+	for _, h := range f.headers {
+		k, v := h[0], h[1]
+		if escape {
+			k, v = stompEscaper.Replace(k), stompEscaper.Replace(v)
+		}
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(f.body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+// parseSTOMPFrame parses the first frame of the buffer, skipping the
+// heartbeats before it, returning the rest of the buffer. The frame is nil
+// if the buffer doesn't hold a whole frame yet.
+func parseSTOMPFrame(buf []byte, escape bool) (*stompFrame, []byte, error) {
+	for len(buf) > 0 && (buf[0] == '\n' || buf[0] == '\r') {
+		buf = buf[1:]
+	}
+	if len(buf) == 0 {
+		return nil, buf, nil
+	}
+	f := &stompFrame{}
+	rest := buf
+	for first := true; ; first = false {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return nil, buf, nil
+		}
+		line := string(bytes.TrimSuffix(rest[:i], []byte("\r")))
+		rest = rest[i+1:]
+		if first {
+			f.command = line
+			continue
+		}
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid header %q", line)
+		}
+		if escape && f.command != "CONNECT" && f.command != "STOMP" {
+			k, v = stompUnescaper.Replace(k), stompUnescaper.Replace(v)
+		}
+		f.set(k, v)
+	}
+
+	// The body ends with a NUL byte, after content-length bytes if set.
+	end := -1
+	if v, ok := f.header("content-length"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("invalid content-length %q", v)
+		}
+		if len(rest) <= n {
+			return nil, buf, nil
+		}
+		if rest[n] != 0 {
+			return nil, nil, errors.New("frame body doesn't end with a NUL byte")
+		}
+		end = n
+	} else if end = bytes.IndexByte(rest, 0); end < 0 {
+		return nil, buf, nil
+	}
+	f.body = bytes.Clone(rest[:end])
+	return f, rest[end+1:], nil
+}
+
+// stompSession is the broker state of a STOMP connection.
+type stompSession struct {
+	version string
+	// subscriptions are the destinations by subscription id.
+	subscriptions map[string]string
+	// transactions are the frames sent in each transaction, delivered once
+	// it commits.
+	transactions map[string][]*stompFrame
+	messageID    int
+}
+
+// negotiateSTOMP returns the highest version accepted by the client, or
+// false if none is supported.
+func negotiateSTOMP(f *stompFrame) (string, bool) {
+	accepted, ok := f.header("accept-version")
+	if !ok {
+		return "1.0", true
+	}
+	for _, v := range stompVersions {
+		for _, a := range strings.Split(accepted, ",") {
+			if strings.TrimSpace(a) == v {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// stompError is an error sent to the client in an ERROR frame before
+// closing the connection.
+type stompError struct {
+	message string
+	detail  string
+}
+
+func (e *stompError) Error() string {
+	if e.detail == "" {
+		return e.message
+	}
+	return e.message + ": " + e.detail
+}
+
+// handle handles a frame of the client, returning the frames to send back
+// and the number of bytes echoed.
+func (ss *stompSession) handle(s *Server, c *session, f *stompFrame) ([]*stompFrame, int, error) {
+	var out []*stompFrame
+	if ss.version == "" {
+		if f.command != "CONNECT" && f.command != "STOMP" {
+			return nil, 0, &stompError{message: "not connected", detail: f.command + " frame before CONNECT"}
+		}
+		v, ok := negotiateSTOMP(f)
+		if !ok {
+			return []*stompFrame{(&stompFrame{command: "ERROR"}).
+				set("version", strings.Join(stompVersions, ",")).
+				set("content-type", "text/plain").
+				set("message", "unsupported protocol version")}, 0, errors.New("unsupported protocol version")
+		}
+		ss.version = v
+		server := "wsecho"
+		if s.version != "" {
+			server += "/" + s.version
+		}
+		host, _ := f.header("host")
+		c.logger.Info("stomp connected", "version", v, "host", host)
+		connected := (&stompFrame{command: "CONNECTED"}).
+			set("version", v).
+			set("heart-beat", "0,0").
+			set("server", server).
+			set("session", strconv.FormatUint(c.id, 10))
+		return []*stompFrame{connected}, 0, nil
+	}
+
+	n := 0
+	switch f.command {
+	case "SEND":
+		dest, ok := f.header("destination")
+		if !ok {
+			return nil, 0, &stompError{message: "missing destination header"}
+		}
+		if tx, ok := f.header("transaction"); ok {
+			if _, ok := ss.transactions[tx]; !ok {
+				return nil, 0, &stompError{message: "unknown transaction", detail: tx}
+			}
+			ss.transactions[tx] = append(ss.transactions[tx], f)
+			break
+		}
+		out, n = ss.deliver(c, dest, f)
+	case "SUBSCRIBE":
+		dest, ok := f.header("destination")
+		if !ok {
+			return nil, 0, &stompError{message: "missing destination header"}
+		}
+		id, ok := f.header("id")
+		if !ok {
+			// Subscription ids are optional in STOMP 1.0.
+			if ss.version != "1.0" {
+				return nil, 0, &stompError{message: "missing id header"}
+			}
+			id = dest
+		}
+		ss.subscriptions[id] = dest
+		c.logger.Debug("stomp subscribed", "id", id, "destination", dest)
+	case "UNSUBSCRIBE":
+		id, ok := f.header("id")
+		if !ok {
+			id, ok = f.header("destination")
+		}
+		if !ok {
+			return nil, 0, &stompError{message: "missing id header"}
+		}
+		delete(ss.subscriptions, id)
+		c.logger.Debug("stomp unsubscribed", "id", id)
+	case "BEGIN", "COMMIT", "ABORT":
+		tx, ok := f.header("transaction")
+		if !ok {
+			return nil, 0, &stompError{message: "missing transaction header"}
+		}
+		frames, exists := ss.transactions[tx]
+		switch {
+		case f.command == "BEGIN" && exists:
+			return nil, 0, &stompError{message: "transaction already started", detail: tx}
+		case f.command == "BEGIN":
+			ss.transactions[tx] = []*stompFrame{}
+		case !exists:
+			return nil, 0, &stompError{message: "unknown transaction", detail: tx}
+		case f.command == "COMMIT":
+			for _, sf := range frames {
+				dest, _ := sf.header("destination")
+				messages, echoed := ss.deliver(c, dest, sf)
+				out = append(out, messages...)
+				n += echoed
+			}
+			delete(ss.transactions, tx)
+		default:
+			delete(ss.transactions, tx)
+		}
+	case "ACK", "NACK":
+	case "DISCONNECT":
+	default:
+		return nil, 0, &stompError{message: "unknown command", detail: f.command}
+	}
+	if receipt, ok := f.header("receipt"); ok {
+		out = append(out, (&stompFrame{command: "RECEIPT"}).set("receipt-id", receipt))
+	}
+	if f.command == "DISCONNECT" {
+		return out, n, errSTOMPDisconnected
+	}
+	return out, n, nil
+}
+
+// deliver returns the MESSAGE frames delivering the frame sent to the
+// destination to the subscriptions of the connection, and the number of
+// bytes echoed.
+func (ss *stompSession) deliver(c *session, dest string, f *stompFrame) ([]*stompFrame, int) {
+	var out []*stompFrame
+	for id, d := range ss.subscriptions {
+		if d != dest {
+			continue
+		}
+		ss.messageID++
+		msgID := strconv.Itoa(ss.messageID)
+		m := (&stompFrame{command: "MESSAGE", body: f.body}).
+			set("subscription", id).
+			set("message-id", msgID).
+			set("destination", dest)
+		if ss.version == "1.2" {
+			m.set("ack", msgID)
+		}
+		for _, h := range f.headers {
+			switch h[0] {
+			case "destination", "transaction", "receipt", "content-length":
+				continue
+			}
+			m.set(h[0], h[1])
+		}
+		m.set("content-length", strconv.Itoa(len(f.body)))
+		out = append(out, m)
+	}
+	if len(out) == 0 {
+		c.logger.Debug("stomp message without subscriptions", "destination", dest)
+	}
+	return out, len(out) * len(f.body)
+}
+
+// stompEcho serves a STOMP connection until it is closed.
+func (s *Server) stompEcho(c *session) error {
+	ctx, conn, logger := c.ctx, c.conn, c.logger
+	ss := &stompSession{
+		subscriptions: map[string]string{},
+		transactions:  map[string][]*stompFrame{},
+	}
+	var buf []byte
+	for {
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return err
+			}
+		}
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return s.readError(ctx, logger, err)
+		}
+		start := time.Now()
+		c.live.active()
+		c.stats.received(len(data))
+
+		// Frames can span websocket messages.
+		buf = append(buf, data...)
+		if s.maxMessageSize > 0 && int64(len(buf)) > s.maxMessageSize {
+			s.metrics.oversized()
+			s.vars.oversized()
+			logger.Warn("message too big", "limit", s.maxMessageSize)
+			c.closeConn(websocket.CloseMessageTooBig, "frame too big")
+			return websocket.ErrReadLimit
+		}
+		for {
+			escape := ss.version != "" && ss.version != "1.0"
+			var f *stompFrame
+			f, buf, err = parseSTOMPFrame(buf, escape)
+			if err != nil {
+				err = &stompError{message: "malformed frame", detail: err.Error()}
+			}
+			if f == nil && err == nil {
+				break
+			}
+			var out []*stompFrame
+			var n int
+			if err == nil {
+				out, n, err = ss.handle(s, c, f)
+			}
+			var serr *stompError
+			if errors.As(err, &serr) {
+				e := (&stompFrame{command: "ERROR", body: []byte(serr.detail)}).
+					set("message", serr.message).
+					set("content-type", "text/plain")
+				if f != nil {
+					if receipt, ok := f.header("receipt"); ok {
+						e.set("receipt-id", receipt)
+					}
+				}
+				out = append(out, e)
+			}
+			escape = ss.version != "" && ss.version != "1.0"
+			for _, o := range out {
+				frame := o.encode(escape && o.command != "CONNECTED")
+				if err := s.setWriteDeadline(conn); err != nil {
+					logger.Error("couldn't set write deadline", "error", err)
+					return err
+				}
+				if err := conn.WriteMessage(mt, frame); err != nil {
+					return s.writeError(logger, err)
+				}
+				c.stats.sent(len(frame))
+			}
+			if n > 0 {
+				s.metrics.echoed(n, time.Since(start))
+				s.vars.echoed(n, time.Since(start))
+			}
+			switch {
+			case errors.Is(err, errSTOMPDisconnected):
+				logger.Info("connection closed", "error", err)
+				c.closeConn(websocket.CloseNormalClosure, "")
+				return nil
+			case err != nil:
+				s.vars.failed()
+				logger.Warn("invalid stomp frame", "error", err)
+				c.closeConn(websocket.CloseProtocolError, "stomp error")
+				return err
+			}
+		}
+	}
+}
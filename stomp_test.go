@@ -0,0 +1,140 @@
+package wsecho
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSTOMPFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		buf     string
+		escape  bool
+		want    *stompFrame
+		rest    string
+		wantErr bool
+	}{
+		{
+			name: "send",
+			buf:  "SEND\ndestination:/queue/a\n\nhello\x00",
+			want: &stompFrame{command: "SEND", headers: [][2]string{{"destination", "/queue/a"}}, body: []byte("hello")},
+		},
+		{
+			name: "crlf",
+			buf:  "SEND\r\ndestination:/queue/a\r\n\r\nhello\x00",
+			want: &stompFrame{command: "SEND", headers: [][2]string{{"destination", "/queue/a"}}, body: []byte("hello")},
+		},
+		{
+			name: "heartbeats",
+			buf:  "\n\r\n\nDISCONNECT\n\n\x00",
+			want: &stompFrame{command: "DISCONNECT", body: []byte{}},
+		},
+		{
+			name: "only heartbeats",
+			buf:  "\n\n",
+		},
+		{
+			name: "next frame",
+			buf:  "SEND\n\na\x00SEND\n\nb\x00",
+			want: &stompFrame{command: "SEND", body: []byte("a")},
+			rest: "SEND\n\nb\x00",
+		},
+		{
+			name: "repeated header",
+			buf:  "SEND\nfoo:1\nfoo:2\n\n\x00",
+			want: &stompFrame{command: "SEND", headers: [][2]string{{"foo", "1"}, {"foo", "2"}}, body: []byte{}},
+		},
+		{
+			name: "content-length with NUL bytes",
+			buf:  "SEND\ncontent-length:3\n\na\x00b\x00rest",
+			want: &stompFrame{command: "SEND", headers: [][2]string{{"content-length", "3"}}, body: []byte("a\x00b")},
+			rest: "rest",
+		},
+		{
+			name: "content-length incomplete",
+			buf:  "SEND\ncontent-length:5\n\nabc",
+			rest: "SEND\ncontent-length:5\n\nabc",
+		},
+		{
+			name:    "content-length without NUL",
+			buf:     "SEND\ncontent-length:1\n\nab\x00",
+			wantErr: true,
+		},
+		{
+			name:    "invalid content-length",
+			buf:     "SEND\ncontent-length:x\n\na\x00",
+			wantErr: true,
+		},
+		{
+			name:    "negative content-length",
+			buf:     "SEND\ncontent-length:-1\n\na\x00",
+			wantErr: true,
+		},
+		{
+			name: "incomplete headers",
+			buf:  "SEND\ndestination:/queue/a",
+			rest: "SEND\ndestination:/queue/a",
+		},
+		{
+			name: "incomplete body",
+			buf:  "SEND\n\nhello",
+			rest: "SEND\n\nhello",
+		},
+		{
+			name:    "header without colon",
+			buf:     "SEND\ndestination\n\n\x00",
+			wantErr: true,
+		},
+		{
+			name:   "escaped header",
+			buf:    "SEND\na\\cb:c\\nd\\\\e\\r\n\n\x00",
+			escape: true,
+			want:   &stompFrame{command: "SEND", headers: [][2]string{{"a:b", "c\nd\\e\r"}}, body: []byte{}},
+		},
+		{
+			name: "escaping disabled",
+			buf:  "SEND\na:c\\nd\n\n\x00",
+			want: &stompFrame{command: "SEND", headers: [][2]string{{"a", "c\\nd"}}, body: []byte{}},
+		},
+		{
+			name:   "connect isn't unescaped",
+			buf:    "CONNECT\nlogin:a\\cb\n\n\x00",
+			escape: true,
+			want:   &stompFrame{command: "CONNECT", headers: [][2]string{{"login", "a\\cb"}}, body: []byte{}},
+		},
+		{
+			name:   "colon in value",
+			buf:    "SEND\nurl:http://a\n\n\x00",
+			escape: true,
+			want:   &stompFrame{command: "SEND", headers: [][2]string{{"url", "http://a"}}, body: []byte{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, rest, err := parseSTOMPFrame([]byte(tt.buf), tt.escape)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(f, tt.want) {
+				t.Errorf("got frame %+v, want %+v", f, tt.want)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("got rest %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestSTOMPFrameEncode(t *testing.T) {
+	f := (&stompFrame{command: "MESSAGE", body: []byte("hi")}).set("a:b", "c\nd")
+	got, _, err := parseSTOMPFrame(f.encode(true), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("got frame %+v, want %+v", got, f)
+	}
+}
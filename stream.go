@@ -0,0 +1,104 @@
+package wsecho
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// copyBuffers are the buffers used to stream messages.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// stream echoes the message read from r without buffering it as a whole,
+// returning the number of bytes echoed and the read or write error. The echo
+// is throttled by the limiter if it isn't nil.
+func stream(ctx context.Context, conn wsConn, messageType int, r io.Reader, limiter *rate.Limiter) (int64, error, error) {
+	wc, err := conn.NextWriter(messageType)
+	if err != nil {
+		return 0, nil, err
+	}
+	var w io.Writer = wc
+	if limiter != nil {
+		w = &throttledWriter{ctx: ctx, w: wc, limiter: limiter}
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	er := &errReader{r: r}
+	n, err := io.CopyBuffer(w, er, *buf)
+	if er.err != nil {
+		return n, er.err, nil
+	}
+	if err != nil {
+		return n, nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return n, nil, err
+	}
+	return n, nil, nil
+}
+
+// errReader records the error returned by the underlying reader, to tell
+// read and write errors apart while copying.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// throttledWriter writes to w in chunks of the burst of the limiter, waiting
+// for the limiter before each chunk.
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), t.limiter.Burst())]
+		if err := t.limiter.WaitN(t.ctx, len(chunk)); err != nil {
+			return n, err
+		}
+		m, err := t.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// throttledReader reads from r in chunks of the burst of the limiter, waiting
+// for the limiter after each chunk.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	p = p[:min(len(p), t.limiter.Burst())]
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
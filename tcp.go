@@ -0,0 +1,347 @@
+package wsecho
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// tcpPrefix is the prefix of the hosts pinged over plain TCP.
+const tcpPrefix = "tcp://"
+
+// tcpBufferSize is the default size of the buffer each TCP echo connection
+// reads into.
+const tcpBufferSize = 32 << 10
+
+// WithTCPEcho serves a plain TCP echo service (RFC 862) on the address,
+// next to the websocket server, to compare the baseline TCP latency with
+// the websocket one. Connections are filtered, tracked, logged and counted
+// like websocket connections, with each read counted as a message.
+func WithTCPEcho(addr string) Option {
+	return func(s *Server) {
+		s.tcpEchoAddr = addr
+	}
+}
+
+// serveTCPEcho serves the TCP echo service until the returned function is
+// called, if it is enabled.
+func (s *Server) serveTCPEcho() (func(), error) {
+	if s.tcpEchoAddr == "" {
+		return func() {}, nil
+	}
+	ln, err := listen(s.tcpEchoAddr)
+	if err != nil {
+		return nil, err
+	}
+	if s.proxyProtocol {
+		ln = &proxyListener{Listener: ln, trusted: s.proxyTrusted}
+	}
+	s.logger.Info("tcp echo listening", "addr", ln.Addr().String())
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("couldn't accept tcp echo", "error", err)
+				}
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveTCPEchoConn(conn)
+			}()
+		}
+	}()
+	return func() {
+		_ = ln.Close()
+		<-done
+		wg.Wait()
+	}, nil
+}
+
+// serveTCPEchoConn echoes back everything read from the connection until
+// the client closes it.
+func (s *Server) serveTCPEchoConn(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	id := s.lastID.Add(1)
+	remote := conn.RemoteAddr().String()
+	logger := s.logger.With("conn", id, "remote_addr", remote)
+
+	if err := s.tracker.refused(); err != nil {
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		logger.Warn("connection refused", "error", err)
+		return
+	}
+	if err := s.checkRemoteAddr(remote); err != nil {
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		logger.Warn("connection refused", "error", err)
+		return
+	}
+	s.metrics.connOpened()
+	defer s.metrics.connClosed()
+	s.vars.connOpened()
+	defer s.vars.connClosed()
+
+	// Without close frames, going away half closes the connection so the
+	// client reads EOF once it has read the pending echoes.
+	var closing bool
+	var mu sync.Mutex
+	tc := &trackedConn{
+		id:         id,
+		remoteAddr: remote,
+		proto:      "tcp",
+		start:      start,
+		goAway: func() {
+			logger.Info("going away")
+			mu.Lock()
+			closing = true
+			mu.Unlock()
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+				return
+			}
+			_ = conn.Close()
+		},
+		kill: func() {
+			_ = conn.Close()
+		},
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			_ = conn.Close()
+		},
+	}
+	defer s.tracker.add(tc)()
+
+	size := s.readBufferSize
+	if size <= 0 {
+		size = tcpBufferSize
+	}
+	buf := make([]byte, size)
+	for {
+		if s.readTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				logger.Error("couldn't set read deadline", "error", err)
+				return
+			}
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+				logger.Info("connection closed")
+			default:
+				s.vars.failed()
+				logger.Info("connection closed", "error", err)
+			}
+			return
+		}
+		echoStart := time.Now()
+		data := buf[:n]
+		tc.stats.received(n)
+		s.capture.record(id, websocket.BinaryMessage, data)
+		if s.previewSize > 0 {
+			logger.Info("preview", "bytes", n, "payload", preview(data, s.previewSize))
+		}
+		mu.Lock()
+		stop := closing
+		mu.Unlock()
+		if stop {
+			continue
+		}
+		if s.writeTimeout > 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+				logger.Error("couldn't set write deadline", "error", err)
+				return
+			}
+		}
+		if _, err := conn.Write(data); err != nil {
+			s.vars.failed()
+			logger.Error("couldn't write", "error", err)
+			return
+		}
+		tc.stats.sent(n)
+		s.metrics.echoed(n, time.Since(echoStart))
+		s.vars.echoed(n, time.Since(echoStart))
+	}
+}
+
+// echoTCP dials the tcp:// host and echoes messages over the plain TCP
+// connection until done, the server closes the connection or it fails.
+// Echoes are read in order by the length of each message, so the first
+// message timing out fails the connection. Messages are recorded in result,
+// starting with the sequence number next.
+func echoTCP(ctx context.Context, cfg *pingConfig, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	limiter *rate.Limiter, host string, id int, gen *payloadGenerator, result *Result, next *int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logger := cfg.logger.With("conn", id)
+
+	ctx, span := cfg.tracer.Start(ctx, "wsecho.connection",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("wsecho.conn", id)),
+	)
+	defer span.End()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, cfg.timeout)
+	conn, err := dial(dialCtx, "tcp", strings.TrimPrefix(host, tcpPrefix))
+	dialCancel()
+	if err != nil {
+		spanError(span, err)
+		return fmt.Errorf("conn %d: couldn't dial: %w", id, err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logger.Error("couldn't close", "error", err)
+		}
+	}()
+	// Unblock pending reads and writes when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	result.Proto = "tcp"
+
+	// Read echoes in the background, keeping up to window messages in
+	// flight.
+	window := cfg.window
+	if window < 1 {
+		window = 1
+	}
+	slots := make(chan struct{}, window)
+	pending := make(chan sent, window)
+	var mu sync.Mutex
+	var connErr error
+	fail := func(err error) {
+		if connErr == nil {
+			connErr = err
+		}
+		cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for s := range pending {
+			if cfg.messageTimeout > 0 {
+				_ = conn.SetReadDeadline(s.start.Add(cfg.messageTimeout))
+			}
+			data := make([]byte, len(s.payload))
+			_, err := io.ReadFull(conn, data)
+			received := time.Now()
+			<-slots
+
+			mu.Lock()
+			switch {
+			case err == nil:
+				elapsed := received.Sub(s.start)
+				result.BytesReceived += int64(len(data))
+				mismatch := !bytes.Equal(data, s.payload)
+				s.span.SetAttributes(attribute.Bool("wsecho.mismatch", mismatch))
+				if mismatch {
+					result.Mismatches++
+					logger.Warn("mismatch", "seq", s.seq, "bytes", len(data))
+				}
+				result.Messages = append(result.Messages, Message{
+					Conn:     id,
+					Seq:      s.seq,
+					Size:     len(s.payload),
+					Sent:     s.start,
+					RTT:      elapsed,
+					Mismatch: mismatch,
+				})
+				if cfg.verbosity >= VerbosityNormal {
+					logger.Info("echo", "seq", s.seq, "bytes", len(s.payload), "rtt", elapsed)
+				}
+			case ctx.Err() != nil:
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				s.span.SetStatus(codes.Error, "timeout")
+				result.Timeouts++
+				result.Messages = append(result.Messages, Message{
+					Conn:    id,
+					Seq:     s.seq,
+					Size:    len(s.payload),
+					Sent:    s.start,
+					Timeout: true,
+				})
+				logger.Warn("message timed out", "seq", s.seq)
+				fail(fmt.Errorf("conn %d: message %d timed out", id, s.seq))
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				logger.Info("connection closed by server")
+				cancel()
+			default:
+				result.Errors++
+				spanError(span, err)
+				fail(fmt.Errorf("conn %d: couldn't read: %w", id, err))
+			}
+			mu.Unlock()
+			s.span.End()
+		}
+	}()
+
+	first := *next
+	for !cfg.done(id, *next) {
+		i := *next
+		if i > first && cfg.interval > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.interval):
+			}
+		}
+		payload := gen.next(i)
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		_, msgSpan := cfg.tracer.Start(ctx, "wsecho.message", trace.WithAttributes(
+			attribute.Int("wsecho.seq", i),
+			attribute.Int("websocket.message.size", len(payload)),
+		))
+		start := time.Now()
+		pending <- sent{seq: i, payload: payload, start: start, span: msgSpan}
+		if _, err := conn.Write(payload); err != nil {
+			mu.Lock()
+			if ctx.Err() == nil {
+				result.Errors++
+				spanError(span, err)
+				fail(fmt.Errorf("conn %d: couldn't write: %w", id, err))
+			}
+			mu.Unlock()
+			break
+		}
+		mu.Lock()
+		result.BytesSent += int64(len(payload))
+		mu.Unlock()
+		*next++
+	}
+	close(pending)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	return connErr
+}
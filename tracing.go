@@ -0,0 +1,20 @@
+package wsecho
+
+import (
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the wsecho spans.
+const tracerName = "github.com/igolaizola/wsecho"
+
+// propagator propagates the trace context on the websocket handshake
+// headers.
+var propagator = propagation.TraceContext{}
+
+// spanError records err on span and marks the span as failed.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,123 @@
+package wsecho
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transform is a transformation applied to payloads before echoing them.
+type Transform string
+
+const (
+	// TransformUppercase converts text payloads to upper case, and ASCII
+	// letters of binary payloads.
+	TransformUppercase Transform = "uppercase"
+	// TransformReverse reverses the characters of text payloads and the
+	// bytes of binary payloads.
+	TransformReverse Transform = "reverse"
+	// TransformBase64 encodes payloads with standard base64.
+	TransformBase64 Transform = "base64"
+	// TransformSequence prefixes payloads with the sequence number of the
+	// echo in the connection, starting at 1, followed by a colon, e.g.
+	// 1:hello.
+	TransformSequence Transform = "sequence"
+)
+
+// WithTransforms applies the transforms in order to the payload of each
+// message before echoing it, so clients can assert the echoes come from the
+// right endpoint. Clients can set the transforms of their connection with
+// comma separated values of the transform query parameter, e.g.
+// ?transform=uppercase,sequence.
+func WithTransforms(ts ...Transform) Option {
+	return func(s *Server) {
+		s.params.transforms = ts
+	}
+}
+
+// ParseTransforms parses comma separated transform names.
+func ParseTransforms(s string) ([]Transform, error) {
+	var ts []Transform
+	for _, name := range strings.Split(s, ",") {
+		switch t := Transform(strings.TrimSpace(name)); t {
+		case TransformUppercase, TransformReverse, TransformBase64, TransformSequence:
+			ts = append(ts, t)
+		default:
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+	}
+	return ts, nil
+}
+
+// transform applies the transforms of the connection to the payload.
+func (p *params) transform(messageType int, payload []byte) []byte {
+	if len(p.transforms) == 0 {
+		return payload
+	}
+	p.sequence++
+	for _, t := range p.transforms {
+		switch t {
+		case TransformUppercase:
+			if messageType == websocket.TextMessage {
+				payload = bytes.ToUpper(payload)
+			} else {
+				payload = asciiUpper(payload)
+			}
+		case TransformReverse:
+			if messageType == websocket.TextMessage && utf8.Valid(payload) {
+				payload = reverseRunes(payload)
+			} else {
+				payload = reverseBytes(payload)
+			}
+		case TransformBase64:
+			encoded := make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
+			base64.StdEncoding.Encode(encoded, payload)
+			payload = encoded
+		case TransformSequence:
+			prefixed := strconv.AppendUint(nil, p.sequence, 10)
+			prefixed = append(prefixed, ':')
+			payload = append(prefixed, payload...)
+		}
+	}
+	return payload
+}
+
+// asciiUpper returns a copy of b with ASCII letters converted to upper case.
+func asciiUpper(b []byte) []byte {
+	upper := make([]byte, len(b))
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper[i] = c
+	}
+	return upper
+}
+
+// reverseBytes returns a copy of b with its bytes in reverse order.
+func reverseBytes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i, c := range b {
+		reversed[len(b)-1-i] = c
+	}
+	return reversed
+}
+
+// reverseRunes returns a copy of the UTF-8 text b with its characters in
+// reverse order.
+func reverseRunes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	i := len(b)
+	for len(b) > 0 {
+		_, size := utf8.DecodeRune(b)
+		i -= size
+		copy(reversed[i:], b[:size])
+		b = b[size:]
+	}
+	return reversed
+}
@@ -0,0 +1,427 @@
+package wsecho
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// udpPrefix is the prefix of the hosts pinged over UDP.
+const udpPrefix = "udp://"
+
+// udpMaxDatagram is the maximum size of a UDP datagram.
+const udpMaxDatagram = 64 << 10
+
+// udpSeqSize is the size of the sequence number prefixed to the datagrams
+// sent to match them with their echoes.
+const udpSeqSize = 8
+
+// udpDefaultTimeout is the time to wait for the echo of a datagram before
+// it is considered lost if no message timeout is set.
+const udpDefaultTimeout = time.Second
+
+const (
+	// udpMinSourcePort is the lowest source port echoed, so spoofed
+	// datagrams can't make the echo service and UDP services on privileged
+	// ports, e.g. echo or chargen, bounce datagrams off each other.
+	udpMinSourcePort = 1024
+	// udpSourceRate is the maximum number of datagrams echoed per second to
+	// each source address, so the service can't be used to flood spoofed
+	// sources.
+	udpSourceRate = 100
+	// udpSourceBurst is the number of datagrams echoed to a source address
+	// at once.
+	udpSourceBurst = 100
+	// udpSources is the maximum number of source addresses rate limited at
+	// once, datagrams from new sources are dropped while they are exceeded.
+	udpSources = 64 << 10
+	// udpSourcesSweep is how often the limiters of idle source addresses
+	// are dropped, and udpSourcesFullSweep how often while they are full.
+	udpSourcesSweep     = time.Minute
+	udpSourcesFullSweep = time.Second
+)
+
+var (
+	// errPrivilegedPort is returned for datagrams from privileged ports.
+	errPrivilegedPort = errors.New("privileged source port")
+	// errSourceRate is returned for datagrams over the rate of their source.
+	errSourceRate = errors.New("source rate exceeded")
+	// errTooManySources is returned for datagrams from new sources while
+	// too many sources are rate limited.
+	errTooManySources = errors.New("too many sources")
+)
+
+// WithUDPEcho serves a UDP echo service (RFC 862) on the address, next to
+// the websocket server, to compare datagram loss and latency with the
+// websocket ones. Datagrams from addresses that aren't allowed or from
+// privileged ports are dropped, as are datagrams exceeding 100 per second
+// from a source address and datagrams from new source addresses while 65536
+// are rate limited, and each echoed datagram is counted as a message.
+func WithUDPEcho(addr string) Option {
+	return func(s *Server) {
+		s.udpEchoAddr = addr
+	}
+}
+
+// serveUDPEcho serves the UDP echo service until the returned function is
+// called, if it is enabled.
+func (s *Server) serveUDPEcho() (func(), error) {
+	if s.udpEchoAddr == "" {
+		return func() {}, nil
+	}
+	pc, err := net.ListenPacket("udp", s.udpEchoAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen udp echo: %w", err)
+	}
+	s.logger.Info("udp echo listening", "addr", pc.LocalAddr().String())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.echoDatagramsFrom(pc)
+	}()
+	return func() {
+		_ = pc.Close()
+		<-done
+	}, nil
+}
+
+// echoDatagramsFrom echoes back every datagram read from the connection
+// until it is closed.
+func (s *Server) echoDatagramsFrom(pc net.PacketConn) {
+	buf := make([]byte, udpMaxDatagram)
+	var sources udpSourceLimiters
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("couldn't read udp echo", "error", err)
+			}
+			return
+		}
+		start := time.Now()
+		remote := addr.String()
+		err = s.checkRemoteAddr(remote)
+		if err == nil {
+			err = sources.check(addr, start)
+		}
+		if err != nil {
+			s.vars.failed()
+			s.logger.Debug("datagram dropped", "remote_addr", remote, "error", err)
+			continue
+		}
+		if s.tracker.refused() != nil {
+			continue
+		}
+		data := buf[:n]
+		s.capture.record(0, websocket.BinaryMessage, data)
+		if s.previewSize > 0 {
+			s.logger.Info("preview", "remote_addr", remote, "bytes", n, "payload", preview(data, s.previewSize))
+		}
+		if _, err := pc.WriteTo(data, addr); err != nil {
+			s.vars.failed()
+			s.logger.Debug("couldn't write udp echo", "remote_addr", remote, "error", err)
+			continue
+		}
+		s.metrics.echoed(n, time.Since(start))
+		s.vars.echoed(n, time.Since(start))
+	}
+}
+
+// udpSourceLimiters limits the datagrams echoed to each source address.
+type udpSourceLimiters struct {
+	limiters map[netip.Addr]*rate.Limiter
+	swept    time.Time
+}
+
+// check returns an error if the datagram from the address must be dropped.
+func (l *udpSourceLimiters) check(addr net.Addr, now time.Time) error {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return errForbidden
+	}
+	ap := ua.AddrPort()
+	if ap.Port() < udpMinSourcePort {
+		return errPrivilegedPort
+	}
+	if l.limiters == nil {
+		l.limiters = map[netip.Addr]*rate.Limiter{}
+		l.swept = now
+	}
+	full := len(l.limiters) >= udpSources
+	if now.Sub(l.swept) > udpSourcesSweep || full && now.Sub(l.swept) > udpSourcesFullSweep {
+		l.sweep(now)
+		full = len(l.limiters) >= udpSources
+	}
+	src := ap.Addr().Unmap()
+	lim, ok := l.limiters[src]
+	if !ok {
+		// Dropping limiters in use would reset the rate of their sources,
+		// so new sources are refused instead.
+		if full {
+			return errTooManySources
+		}
+		lim = rate.NewLimiter(udpSourceRate, udpSourceBurst)
+		l.limiters[src] = lim
+	}
+	if !lim.AllowN(now, 1) {
+		return errSourceRate
+	}
+	return nil
+}
+
+// sweep drops the limiters of the sources that are idle, whose burst is
+// full again, as they don't limit them anymore.
+func (l *udpSourceLimiters) sweep(now time.Time) {
+	for src, lim := range l.limiters {
+		if lim.TokensAt(now) >= udpSourceBurst {
+			delete(l.limiters, src)
+		}
+	}
+	l.swept = now
+}
+
+// echoUDP sends datagrams to the udp:// host until done, matching them
+// with their echoes by the sequence number they are prefixed with.
+// Datagrams not echoed within the message timeout, one second by default,
+// are recorded as lost, and late, duplicated or reordered echoes are
+// detected. Messages are recorded in result, starting with the sequence
+// number next.
+func echoUDP(ctx context.Context, cfg *pingConfig, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	limiter *rate.Limiter, host string, id int, gen *payloadGenerator, result *Result, next *int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logger := cfg.logger.With("conn", id)
+
+	ctx, span := cfg.tracer.Start(ctx, "wsecho.connection",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("wsecho.conn", id)),
+	)
+	defer span.End()
+
+	conn, err := dial(ctx, "udp", strings.TrimPrefix(host, udpPrefix))
+	if err != nil {
+		spanError(span, err)
+		return fmt.Errorf("conn %d: couldn't dial: %w", id, err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logger.Error("couldn't close", "error", err)
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	result.Proto = "udp"
+
+	timeout := cfg.messageTimeout
+	if timeout <= 0 {
+		timeout = udpDefaultTimeout
+	}
+	window := cfg.window
+	if window < 1 {
+		window = 1
+	}
+	slots := make(chan struct{}, window)
+
+	// Datagrams waiting for their echo by sequence number.
+	type inflight struct {
+		sent
+		timer *time.Timer
+	}
+	var mu sync.Mutex
+	pending := map[int]*inflight{}
+	last := -1
+	var connErr error
+
+	// Read echoes in the background.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			n, err := conn.Read(buf)
+			received := time.Now()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// Datagrams are refused while the server isn't listening,
+				// they are recorded as lost.
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					logger.Warn("datagram refused")
+					continue
+				}
+				mu.Lock()
+				result.Errors++
+				if connErr == nil {
+					connErr = fmt.Errorf("conn %d: couldn't read: %w", id, err)
+				}
+				mu.Unlock()
+				spanError(span, err)
+				cancel()
+				return
+			}
+			if n < udpSeqSize {
+				logger.Warn("unexpected datagram", "bytes", n)
+				continue
+			}
+			seq := int(binary.BigEndian.Uint64(buf[:udpSeqSize]))
+			data := buf[udpSeqSize:n]
+
+			mu.Lock()
+			p, ok := pending[seq]
+			if !ok {
+				mu.Unlock()
+				logger.Warn("late or duplicated echo", "seq", seq)
+				continue
+			}
+			delete(pending, seq)
+			p.timer.Stop()
+			<-slots
+			result.BytesReceived += int64(n)
+			if seq < last {
+				logger.Warn("reordered echo", "seq", seq, "after", last)
+			}
+			if seq > last {
+				last = seq
+			}
+			elapsed := received.Sub(p.start)
+			mismatch := !bytes.Equal(data, p.payload)
+			if mismatch {
+				result.Mismatches++
+				logger.Warn("mismatch", "seq", seq, "sent_bytes", len(p.payload), "received_bytes", len(data))
+			}
+			result.Messages = append(result.Messages, Message{
+				Conn:     id,
+				Seq:      seq,
+				Size:     len(p.payload),
+				Sent:     p.start,
+				RTT:      elapsed,
+				Mismatch: mismatch,
+			})
+			mu.Unlock()
+			p.span.SetAttributes(attribute.Bool("wsecho.mismatch", mismatch))
+			p.span.End()
+			if cfg.verbosity >= VerbosityNormal {
+				logger.Info("echo", "seq", seq, "bytes", len(p.payload), "rtt", elapsed)
+			}
+		}
+	}()
+
+	first := *next
+	buf := make([]byte, 0, udpMaxDatagram)
+	for !cfg.done(id, *next) {
+		i := *next
+		if i > first && cfg.interval > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.interval):
+			}
+		}
+		payload := gen.next(i)
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		_, msgSpan := cfg.tracer.Start(ctx, "wsecho.message", trace.WithAttributes(
+			attribute.Int("wsecho.seq", i),
+			attribute.Int("websocket.message.size", len(payload)),
+		))
+		buf = binary.BigEndian.AppendUint64(buf[:0], uint64(i))
+		buf = append(buf, payload...)
+
+		// Record the datagram as lost if it isn't echoed in time.
+		p := &inflight{sent: sent{seq: i, payload: payload, start: time.Now(), span: msgSpan}}
+		mu.Lock()
+		pending[i] = p
+		p.timer = time.AfterFunc(timeout, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := pending[i]; !ok {
+				return
+			}
+			delete(pending, i)
+			<-slots
+			result.Lost++
+			result.Messages = append(result.Messages, Message{
+				Conn:    id,
+				Seq:     i,
+				Size:    len(payload),
+				Sent:    p.start,
+				Timeout: true,
+			})
+			msgSpan.SetStatus(codes.Error, "lost")
+			msgSpan.End()
+			logger.Warn("datagram lost", "seq", i)
+		})
+		mu.Unlock()
+		if _, err := conn.Write(buf); err != nil {
+			mu.Lock()
+			if _, ok := pending[i]; ok {
+				delete(pending, i)
+				p.timer.Stop()
+				msgSpan.End()
+				<-slots
+			}
+			if ctx.Err() == nil {
+				result.Errors++
+				if connErr == nil {
+					connErr = fmt.Errorf("conn %d: couldn't write: %w", id, err)
+				}
+			}
+			mu.Unlock()
+			spanError(span, err)
+			break
+		}
+		mu.Lock()
+		result.BytesSent += int64(len(buf))
+		mu.Unlock()
+		*next++
+	}
+
+	// Wait for the echoes or the loss of the datagrams in flight.
+	for i := 0; i < window; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	for seq, p := range pending {
+		p.timer.Stop()
+		p.span.End()
+		delete(pending, seq)
+	}
+	// Echoes are received out of order, keep the messages in the order
+	// they were sent like on websockets.
+	sort.SliceStable(result.Messages, func(i, j int) bool {
+		return result.Messages[i].Sent.Before(result.Messages[j].Sent)
+	})
+	return connErr
+}
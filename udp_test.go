@@ -0,0 +1,118 @@
+package wsecho
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestUDPSourceLimitersCheck(t *testing.T) {
+	udpAddr := func(s string) net.Addr {
+		return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s))
+	}
+	victim := udpAddr("192.0.2.1:5000")
+	// datagram is sent n times, one by default, at the time since the
+	// start, and only the last one returns the error.
+	type datagram struct {
+		addr net.Addr
+		at   time.Duration
+		n    int
+		err  error
+	}
+	tests := []struct {
+		name      string
+		busy      int
+		datagrams []datagram
+	}{
+		{
+			name:      "not udp",
+			datagrams: []datagram{{addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, err: errForbidden}},
+		},
+		{
+			name:      "privileged port",
+			datagrams: []datagram{{addr: udpAddr("192.0.2.1:53"), err: errPrivilegedPort}},
+		},
+		{
+			name:      "burst",
+			datagrams: []datagram{{addr: victim, n: udpSourceBurst}},
+		},
+		{
+			name:      "rate exceeded",
+			datagrams: []datagram{{addr: victim, n: udpSourceBurst + 1, err: errSourceRate}},
+		},
+		{
+			name: "rate refilled",
+			datagrams: []datagram{
+				{addr: victim, n: udpSourceBurst + 1, err: errSourceRate},
+				{addr: victim, at: time.Second / udpSourceRate},
+			},
+		},
+		{
+			name: "other source",
+			datagrams: []datagram{
+				{addr: victim, n: udpSourceBurst + 1, err: errSourceRate},
+				{addr: udpAddr("192.0.2.2:5000")},
+			},
+		},
+		{
+			name: "ipv4-mapped source",
+			datagrams: []datagram{
+				{addr: victim, n: udpSourceBurst},
+				{addr: udpAddr("[::ffff:192.0.2.1]:5000"), err: errSourceRate},
+			},
+		},
+		{
+			name:      "too many sources",
+			busy:      udpSources,
+			datagrams: []datagram{{addr: victim, err: errTooManySources}},
+		},
+		{
+			name: "too many sources keep their rate",
+			busy: udpSources - 1,
+			datagrams: []datagram{
+				{addr: victim, n: udpSourceBurst + 1, err: errSourceRate},
+				{addr: udpAddr("192.0.2.2:5000"), err: errTooManySources},
+				{addr: victim, err: errSourceRate},
+			},
+		},
+		{
+			name:      "idle sources swept",
+			busy:      udpSources,
+			datagrams: []datagram{{addr: victim, at: udpSourcesFullSweep + time.Second}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			var l udpSourceLimiters
+			if tt.busy > 0 {
+				l.limiters = map[netip.Addr]*rate.Limiter{}
+				l.swept = start
+				for i := 0; i < tt.busy; i++ {
+					lim := rate.NewLimiter(udpSourceRate, udpSourceBurst)
+					lim.AllowN(start, udpSourceBurst)
+					l.limiters[netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})] = lim
+				}
+			}
+			for i, d := range tt.datagrams {
+				n := d.n
+				if n == 0 {
+					n = 1
+				}
+				for j := 0; j < n; j++ {
+					var want error
+					if j == n-1 {
+						want = d.err
+					}
+					if err := l.check(d.addr, start.Add(d.at)); !errors.Is(err, want) {
+						t.Fatalf("datagram %d.%d: got error %v, want %v", i, j, err, want)
+					}
+				}
+			}
+		})
+	}
+}
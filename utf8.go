@@ -0,0 +1,33 @@
+package wsecho
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// errInvalidUTF8 is returned when a text message isn't valid UTF-8.
+var errInvalidUTF8 = errors.New("invalid UTF-8")
+
+// WithUTF8Validation sets whether the payload of text messages is validated
+// as UTF-8. Connections sending invalid text messages are closed with status
+// 1007 (invalid payload data). It is enabled by default, disable it to check
+// how clients and proxies handle invalid UTF-8 echoed back. Text messages
+// are buffered to be validated, binary messages are still streamed back.
+func WithUTF8Validation(enabled bool) Option {
+	return func(s *Server) {
+		s.noUTF8Validation = !enabled
+	}
+}
+
+// validateUTF8 returns true if text messages must be validated as UTF-8.
+func (s *Server) validateUTF8() bool {
+	return s.autobahn || !s.noUTF8Validation
+}
+
+// invalidUTF8 returns true if the message is a text message that must be
+// validated and isn't valid UTF-8.
+func (s *Server) invalidUTF8(messageType int, data []byte) bool {
+	return messageType == websocket.TextMessage && s.validateUTF8() && !utf8.Valid(data)
+}
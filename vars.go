@@ -0,0 +1,95 @@
+package wsecho
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// vars contains the expvar counters of a server.
+// All methods are no-ops on a nil receiver.
+type vars struct {
+	m                 *expvar.Map
+	connections       *expvar.Int
+	activeConnections *expvar.Int
+	messages          *expvar.Int
+	bytes             *expvar.Int
+	echoNanoseconds   *expvar.Int
+	errors            *expvar.Int
+	oversizedMessages *expvar.Int
+}
+
+func newVars() *vars {
+	v := &vars{
+		m:                 new(expvar.Map).Init(),
+		connections:       new(expvar.Int),
+		activeConnections: new(expvar.Int),
+		messages:          new(expvar.Int),
+		bytes:             new(expvar.Int),
+		echoNanoseconds:   new(expvar.Int),
+		errors:            new(expvar.Int),
+		oversizedMessages: new(expvar.Int),
+	}
+	v.m.Set("connections", v.connections)
+	v.m.Set("active_connections", v.activeConnections)
+	v.m.Set("messages", v.messages)
+	v.m.Set("bytes", v.bytes)
+	v.m.Set("echo_nanoseconds", v.echoNanoseconds)
+	v.m.Set("errors", v.errors)
+	v.m.Set("oversized_messages", v.oversizedMessages)
+	return v
+}
+
+// handler serves the counters of the server under the wsecho key along with
+// the globally published variables, in the same format as expvar.Handler.
+// The counters aren't published globally so multiple servers can run in the
+// same process.
+func (v *vars) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n%q: %s", "wsecho", v.m)
+		expvar.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, ",\n%q: %s", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
+
+func (v *vars) connOpened() {
+	if v == nil {
+		return
+	}
+	v.connections.Add(1)
+	v.activeConnections.Add(1)
+}
+
+func (v *vars) connClosed() {
+	if v == nil {
+		return
+	}
+	v.activeConnections.Add(-1)
+}
+
+func (v *vars) failed() {
+	if v == nil {
+		return
+	}
+	v.errors.Add(1)
+}
+
+func (v *vars) oversized() {
+	if v == nil {
+		return
+	}
+	v.oversizedMessages.Add(1)
+}
+
+func (v *vars) echoed(n int, d time.Duration) {
+	if v == nil {
+		return
+	}
+	v.messages.Add(1)
+	v.bytes.Add(int64(n))
+	v.echoNanoseconds.Add(int64(d))
+}
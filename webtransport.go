@@ -0,0 +1,473 @@
+package wsecho
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// WithWebTransport serves WebTransport over HTTP/3 on the UDP address with
+// the certificate and key files, next to the websocket server. Each
+// bidirectional stream opened by the client is echoed back once the client
+// closes its side, and each datagram is echoed back as is.
+func WithWebTransport(addr, certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.webTransportAddr = addr
+		s.webTransportCert = certFile
+		s.webTransportKey = keyFile
+	}
+}
+
+// serveWebTransport serves WebTransport until the returned function is
+// called, if it is enabled.
+func (s *Server) serveWebTransport() (func(), error) {
+	if s.webTransportAddr == "" {
+		return func() {}, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.webTransportCert, s.webTransportKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load webtransport key pair: %w", err)
+	}
+	pc, err := net.ListenPacket("udp", s.webTransportAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen webtransport: %w", err)
+	}
+	wt := &webtransport.Server{
+		H3: http3.Server{
+			Addr:      pc.LocalAddr().String(),
+			TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		},
+		CheckOrigin: s.checkOrigin,
+	}
+	wt.H3.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveWebTransportSession(wt, w, r)
+	})
+	s.logger.Info("webtransport listening", "addr", pc.LocalAddr().String())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := wt.Serve(pc); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("couldn't serve webtransport", "error", err)
+		}
+	}()
+	return func() {
+		if err := wt.Close(); err != nil {
+			s.logger.Error("couldn't close webtransport", "error", err)
+		}
+		_ = pc.Close()
+		<-done
+	}, nil
+}
+
+// serveWebTransportSession upgrades the request to a WebTransport session
+// and echoes its streams and datagrams until the session ends.
+func (s *Server) serveWebTransportSession(wt *webtransport.Server, w http.ResponseWriter, r *http.Request) {
+	r = s.forwarded(r)
+	start := time.Now()
+	id := s.lastID.Add(1)
+	logger := s.logger.With("conn", id, "remote_addr", r.RemoteAddr)
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer.Start(ctx, "wsecho.webtransport",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("net.peer.addr", r.RemoteAddr),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.Int64("wsecho.conn", int64(id)),
+		),
+	)
+	defer span.End()
+
+	refuse := func(err error, status int, msg string) {
+		spanError(span, err)
+		s.metrics.upgradeFailed()
+		s.vars.failed()
+		s.accessLog.log(r, id, start, "", false, err)
+		logger.Warn(msg, "error", err)
+		http.Error(w, http.StatusText(status), status)
+	}
+	if err := s.tracker.refused(); err != nil {
+		refuse(err, http.StatusServiceUnavailable, "connection refused")
+		return
+	}
+	if err := s.checkAddr(r); err != nil {
+		refuse(err, http.StatusForbidden, "connection refused")
+		return
+	}
+	if _, err := s.authorize(w, r); err != nil {
+		refuse(err, http.StatusUnauthorized, "couldn't authorize")
+		return
+	}
+
+	// The QUIC connection is kept to close it without waiting for the
+	// client.
+	hj, ok := w.(http3.Hijacker)
+	if !ok {
+		refuse(errors.New("response can't be hijacked"), http.StatusInternalServerError, "couldn't upgrade")
+		return
+	}
+	qconn := hj.Connection()
+	w.Header().Set(ConnIDHeader, strconv.FormatUint(id, 10))
+	sess, err := wt.Upgrade(w, r)
+	if err != nil {
+		refuse(err, http.StatusBadRequest, "couldn't upgrade")
+		return
+	}
+	var connErr error
+	defer func() {
+		s.accessLog.log(r, id, start, "", true, connErr)
+	}()
+	s.metrics.connOpened()
+	defer s.metrics.connClosed()
+	s.vars.connOpened()
+	defer s.vars.connClosed()
+	defer closeSession(sess, 0, "")
+
+	tc := &trackedConn{
+		id:         id,
+		remoteAddr: r.RemoteAddr,
+		uri:        r.URL.Path,
+		proto:      r.Proto,
+		start:      start,
+		goAway: func() {
+			logger.Info("going away")
+			closeSession(sess, websocket.CloseGoingAway, errShuttingDown.Error())
+		},
+		kill: func() {
+			_ = qconn.CloseWithError(0, "")
+		},
+		close: func(code int, reason string) {
+			logger.Info("closing on admin request", "code", code, "reason", reason)
+			closeSession(sess, code, reason)
+		},
+	}
+	defer s.tracker.add(tc)()
+
+	ctx = sess.Context()
+	go s.echoDatagrams(ctx, sess, &tc.stats)
+	for {
+		str, err := sess.AcceptStream(ctx)
+		if err != nil {
+			var sessErr *webtransport.SessionError
+			if errors.As(err, &sessErr) {
+				logger.Info("close", "code", sessErr.ErrorCode, "text", sessErr.Message)
+				return
+			}
+			if ctx.Err() == nil {
+				connErr = err
+				logger.Error("couldn't accept stream", "error", err)
+			}
+			return
+		}
+		go s.echoStream(str, &tc.stats, logger)
+	}
+}
+
+// closeSession closes the session with the code and reason in the
+// background, closing waits for the client to close it too.
+func closeSession(sess *webtransport.Session, code int, reason string) {
+	go func() {
+		_ = sess.CloseWithError(webtransport.SessionErrorCode(code), reason)
+	}()
+}
+
+// echoStream reads the stream until the client closes its side and writes
+// it back.
+func (s *Server) echoStream(str webtransport.Stream, stats *connStats, logger *slog.Logger) {
+	var src io.Reader = str
+	if s.maxMessageSize > 0 {
+		src = io.LimitReader(str, s.maxMessageSize+1)
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		s.vars.failed()
+		logger.Debug("couldn't read stream", "error", err)
+		str.CancelWrite(0)
+		return
+	}
+	start := time.Now()
+	if s.maxMessageSize > 0 && int64(len(data)) > s.maxMessageSize {
+		s.metrics.oversized()
+		s.vars.oversized()
+		logger.Warn("stream too big", "limit", s.maxMessageSize)
+		str.CancelRead(websocket.CloseMessageTooBig)
+		str.CancelWrite(websocket.CloseMessageTooBig)
+		return
+	}
+	stats.received(len(data))
+	if s.writeTimeout > 0 {
+		_ = str.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	if _, err := str.Write(data); err != nil {
+		s.vars.failed()
+		logger.Debug("couldn't write stream", "error", err)
+		str.CancelWrite(0)
+		return
+	}
+	if err := str.Close(); err != nil {
+		logger.Debug("couldn't close stream", "error", err)
+	}
+	stats.sent(len(data))
+	s.metrics.echoed(len(data), time.Since(start))
+	s.vars.echoed(len(data), time.Since(start))
+}
+
+// echoDatagrams echoes back the datagrams of the session until it ends.
+func (s *Server) echoDatagrams(ctx context.Context, sess *webtransport.Session, stats *connStats) {
+	for {
+		data, err := sess.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		stats.received(len(data))
+		if err := sess.SendDatagram(data); err != nil {
+			s.vars.failed()
+			continue
+		}
+		stats.sent(len(data))
+		s.metrics.echoed(len(data), time.Since(start))
+		s.vars.echoed(len(data), time.Since(start))
+	}
+}
+
+// WithPingWebTransport dials https hosts with WebTransport over HTTP/3 instead
+// of websockets, sending each message on its own bidirectional stream, so
+// the round trip times can be compared with the websocket ones.
+func WithPingWebTransport(enabled bool) PingOption {
+	return func(c *pingConfig) {
+		c.webTransport = enabled
+	}
+}
+
+// echoWebTransport dials the server with WebTransport and echoes each
+// message on its own stream until done, the session is closed or it fails.
+// Messages are recorded in result, starting with the sequence number next.
+func echoWebTransport(ctx context.Context, cfg *pingConfig, tlsConfig *tls.Config, limiter *rate.Limiter, host string, id int,
+	gen *payloadGenerator, result *Result, next *int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logger := cfg.logger.With("conn", id)
+
+	ctx, span := cfg.tracer.Start(ctx, "wsecho.connection",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("wsecho.conn", id)),
+	)
+	defer span.End()
+
+	headers := cfg.headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(headers))
+	if cfg.username != "" || cfg.password != "" {
+		req := &http.Request{Header: headers}
+		req.SetBasicAuth(cfg.username, cfg.password)
+	}
+
+	// Dial the host, keeping the QUIC connection to close it along with
+	// the session.
+	var qconn quic.EarlyConnection
+	dialer := &webtransport.Dialer{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			EnableDatagrams:      true,
+			HandshakeIdleTimeout: cfg.dialTimeout,
+		},
+		DialAddr: func(ctx context.Context, addr string, tlsCfg *tls.Config, quicCfg *quic.Config) (quic.EarlyConnection, error) {
+			var err error
+			qconn, err = quic.DialAddrEarly(ctx, addr, tlsCfg, quicCfg)
+			return qconn, err
+		},
+	}
+	defer dialer.Close()
+	dialCtx, dialCancel := context.WithTimeout(ctx, cfg.timeout)
+	resp, sess, err := dialer.Dial(dialCtx, host, headers)
+	dialCancel()
+	if qconn != nil {
+		defer func() { _ = qconn.CloseWithError(0, "") }()
+	}
+	if err != nil {
+		spanError(span, err)
+		return fmt.Errorf("conn %d: couldn't dial: %w", id, err)
+	}
+	defer func() { _ = sess.CloseWithError(0, "") }()
+	if id := resp.Header.Get(ConnIDHeader); id != "" {
+		logger = logger.With("server_conn", id)
+		span.SetAttributes(attribute.String("wsecho.server_conn", id))
+	}
+	result.Proto = resp.Proto
+
+	// Send messages on their own streams, keeping up to window streams in
+	// flight.
+	window := cfg.window
+	if window < 1 {
+		window = 1
+	}
+	slots := make(chan struct{}, window)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var connErr error
+	fail := func(err error) {
+		if connErr == nil {
+			connErr = err
+		}
+		cancel()
+	}
+	first := *next
+	for !cfg.done(id, *next) {
+		i := *next
+		if i > first && cfg.interval > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.interval):
+			}
+		}
+		payload := gen.next(i)
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		*next++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			_, msgSpan := cfg.tracer.Start(ctx, "wsecho.message", trace.WithAttributes(
+				attribute.Int("wsecho.seq", i),
+				attribute.Int("websocket.message.size", len(payload)),
+			))
+			defer msgSpan.End()
+			e := echoWebTransportStream(ctx, cfg, sess, payload)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if e.written {
+				result.BytesSent += int64(len(payload))
+			}
+			var sessErr *webtransport.SessionError
+			switch {
+			case e.err == nil:
+				result.BytesReceived += int64(len(e.data))
+				mismatch := !bytes.Equal(e.data, payload)
+				msgSpan.SetAttributes(attribute.Bool("wsecho.mismatch", mismatch))
+				if mismatch {
+					result.Mismatches++
+					logger.Warn("mismatch", "seq", i, "sent_bytes", len(payload), "received_bytes", len(e.data))
+				}
+				result.Messages = append(result.Messages, Message{
+					Conn:     id,
+					Seq:      i,
+					Size:     len(payload),
+					Sent:     e.start,
+					RTT:      e.rtt,
+					Mismatch: mismatch,
+				})
+				if cfg.verbosity >= VerbosityNormal {
+					logger.Info("echo", "seq", i, "bytes", len(payload), "rtt", e.rtt)
+				}
+			case ctx.Err() != nil:
+			case errors.Is(e.err, os.ErrDeadlineExceeded):
+				msgSpan.SetStatus(codes.Error, "timeout")
+				result.Timeouts++
+				result.Messages = append(result.Messages, Message{
+					Conn:    id,
+					Seq:     i,
+					Size:    len(payload),
+					Sent:    e.start,
+					Timeout: true,
+				})
+				logger.Warn("message timed out", "seq", i)
+				if !cfg.continueOnTimeout {
+					fail(fmt.Errorf("conn %d: message %d timed out", id, i))
+				}
+			case errors.As(e.err, &sessErr):
+				logger.Info("close", "code", sessErr.ErrorCode, "text", sessErr.Message)
+				cancel()
+			default:
+				result.Errors++
+				spanError(span, e.err)
+				fail(fmt.Errorf("conn %d: couldn't echo: %w", id, e.err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Streams in flight complete out of order, keep the messages in the
+	// order they were sent like on websockets.
+	sort.SliceStable(result.Messages, func(i, j int) bool {
+		return result.Messages[i].Sent.Before(result.Messages[j].Sent)
+	})
+	return connErr
+}
+
+// streamEcho is the echo of a message sent on its own stream.
+type streamEcho struct {
+	data    []byte
+	start   time.Time
+	rtt     time.Duration
+	written bool
+	err     error
+}
+
+// echoWebTransportStream sends the payload on a new stream, closing its
+// side, and reads the echo until the server closes the stream.
+func echoWebTransportStream(ctx context.Context, cfg *pingConfig, sess *webtransport.Session, payload []byte) streamEcho {
+	str, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		return streamEcho{err: err}
+	}
+	e := streamEcho{start: time.Now()}
+	if cfg.messageTimeout > 0 {
+		_ = str.SetDeadline(e.start.Add(cfg.messageTimeout))
+	}
+	// Unblock the stream when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = str.SetDeadline(time.Now())
+	})
+	defer stop()
+	if _, err := str.Write(payload); err != nil {
+		str.CancelRead(0)
+		e.err = err
+		return e
+	}
+	if err := str.Close(); err != nil {
+		str.CancelRead(0)
+		e.err = err
+		return e
+	}
+	e.written = true
+	e.data, e.err = io.ReadAll(str)
+	e.rtt = time.Since(e.start)
+	if e.err != nil {
+		str.CancelRead(0)
+	}
+	return e
+}
@@ -3,186 +3,362 @@ package wsecho
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // Server serves the wsecho server.
-func Serve(ctx context.Context, addr string) error {
-	log.Printf("server listening on %s\n", addr)
+// The address can be a TCP address or a unix socket path, e.g.
+// unix:///tmp/wsecho.sock.
+func Serve(ctx context.Context, addr string, opts ...Option) error {
+	return ServeAddresses(ctx, []Address{{Addr: addr}}, opts...)
+}
 
-	// Create a new server mux.
-	mux := http.NewServeMux()
-	mux.Handle("/", NewServer())
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		_, _ = w.Write([]byte("ok"))
-	})
+// ServeListener serves the wsecho server on the provided listener.
+// The listener is closed when the server shuts down.
+func ServeListener(ctx context.Context, ln net.Listener, opts ...Option) error {
+	return serve(ctx, []listener{httpListener(ln)}, opts)
+}
 
-	// Create a new server.
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
+// ServeTLS serves the wsecho server over TLS using the provided certificate
+// and key files.
+func ServeTLS(ctx context.Context, addr, certFile, keyFile string, opts ...Option) error {
+	return ServeAddresses(ctx, []Address{{Addr: addr, CertFile: certFile, KeyFile: keyFile}}, opts...)
+}
 
-	// Listen until the context is cancelled.
-	go func() {
-		<-ctx.Done()
-		log.Println("server shutting down")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := srv.Shutdown(ctx); err != nil {
-			log.Printf("couldn't shutdown: %v\n", err)
+// ServeMutualTLS serves the wsecho server over TLS requiring clients to
+// present a certificate signed by one of the CAs in caFile.
+func ServeMutualTLS(ctx context.Context, addr, certFile, keyFile, caFile string, opts ...Option) error {
+	return ServeAddresses(ctx, []Address{{Addr: addr, CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}}, opts...)
+}
+
+// Address is an address served by ServeAddresses.
+type Address struct {
+	// Addr is a TCP address or a unix socket path prefixed with unix://.
+	Addr string
+	// CertFile and KeyFile serve the address over TLS if they are set.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile requires clients to present a certificate signed by one
+	// of its CAs if it is set, along with CertFile and KeyFile.
+	ClientCAFile string
+	// Redirect, if set, redirects every request to the TLS address instead
+	// of serving it, see RedirectHandler. It can't be used with TLS.
+	Redirect string
+}
+
+// ServeAddresses serves the wsecho server on every address at once, e.g.
+// plaintext on :8080, TLS on :8443 and a unix socket. The addresses share
+// the handlers, connections and shutdown of a single server, which stops
+// serving all of them if any fails.
+func ServeAddresses(ctx context.Context, addrs []Address, opts ...Option) error {
+	if len(addrs) == 0 {
+		return errors.New("missing addresses")
+	}
+	lns := make([]listener, 0, len(addrs))
+	for _, a := range addrs {
+		l, err := a.listen()
+		if err != nil {
+			for _, l := range lns {
+				_ = l.ln.Close()
+			}
+			return err
 		}
-	}()
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("couldn't serve: %w", err)
+		lns = append(lns, l)
 	}
-	return nil
+	return serve(ctx, lns, opts)
 }
 
-type Server struct {
-	upgrader websocket.Upgrader
+// listen creates the listener of the address.
+func (a Address) listen() (listener, error) {
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		return listener{}, fmt.Errorf("%s: cert and key must be provided together", a.Addr)
+	}
+	if a.ClientCAFile != "" && a.CertFile == "" {
+		return listener{}, fmt.Errorf("%s: client ca requires cert and key", a.Addr)
+	}
+	if a.Redirect != "" && a.CertFile != "" {
+		return listener{}, fmt.Errorf("%s: redirect can't be used with cert and key", a.Addr)
+	}
+	var cfg *tls.Config
+	if a.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile); err != nil {
+			return listener{}, fmt.Errorf("couldn't load key pair: %w", err)
+		}
+	}
+	if a.ClientCAFile != "" {
+		ca, err := os.ReadFile(a.ClientCAFile)
+		if err != nil {
+			return listener{}, fmt.Errorf("couldn't read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return listener{}, fmt.Errorf("couldn't parse client ca %s", a.ClientCAFile)
+		}
+		cfg = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	ln, err := listen(a.Addr)
+	if err != nil {
+		return listener{}, err
+	}
+	if a.CertFile == "" {
+		l := httpListener(ln)
+		l.redirect = a.Redirect
+		return l, nil
+	}
+	return listener{ln: ln, tls: true, run: func(srv *http.Server, ln net.Listener) error {
+		srv.TLSConfig = cfg
+		return srv.ServeTLS(ln, a.CertFile, a.KeyFile)
+	}}, nil
 }
 
-func NewServer() *Server {
-	return &Server{
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
+// ServeAutocert serves the wsecho server over TLS using certificates obtained
+// and renewed automatically from Let's Encrypt for the given hosts.
+// Certificates are cached in cacheDir if it isn't empty.
+func ServeAutocert(ctx context.Context, addr, cacheDir string, hosts []string, opts ...Option) error {
+	if len(hosts) == 0 {
+		return errors.New("missing hosts")
 	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+	}
+	if cacheDir != "" {
+		m.Cache = autocert.DirCache(cacheDir)
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, []listener{{ln: ln, tls: true, run: func(srv *http.Server, ln net.Listener) error {
+		srv.TLSConfig = m.TLSConfig()
+		return srv.ServeTLS(ln, "", "")
+	}}}, opts)
 }
 
-// ServeHTTP implements http.Handler.ServeHTTP
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
+// listener is a listener and the function serving an http server on it.
+type listener struct {
+	ln  net.Listener
+	run func(*http.Server, net.Listener) error
+	// redirect is the TLS address requests are redirected to, if any.
+	redirect string
+	// tls is true if the listener serves TLS, and so HTTP/2.
+	tls bool
+	// handler overrides the handler served on the listener if not nil.
+	handler http.Handler
+}
+
+// httpListener serves plain http on the listener.
+func httpListener(ln net.Listener) listener {
+	return listener{ln: ln, run: func(srv *http.Server, ln net.Listener) error {
+		return srv.Serve(ln)
+	}}
+}
 
-	// Websocket connection
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+const unixPrefix = "unix://"
+
+// listen creates a listener for a TCP address or a unix socket path
+// prefixed with unix://.
+func listen(addr string) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, unixPrefix) {
+		network = "unix"
+		addr = strings.TrimPrefix(addr, unixPrefix)
+		// Remove stale socket files left by previous runs.
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("couldn't remove socket: %w", err)
+			}
+		}
+	}
+	ln, err := net.Listen(network, addr)
 	if err != nil {
-		log.Println(fmt.Errorf("couldn't upgrade: %w", err))
-		return
+		return nil, fmt.Errorf("couldn't listen: %w", err)
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Println(fmt.Errorf("couldn't close: %w", err))
+	return ln, nil
+}
+
+func serve(ctx context.Context, lns []listener, opts []Option) error {
+	// Create a new server mux.
+	mux := http.NewServeMux()
+	s := NewServer(opts...)
+	for i, l := range lns {
+		if s.proxyProtocol {
+			lns[i].ln = &proxyListener{Listener: l.ln, trusted: s.proxyTrusted}
 		}
-	}()
+		if l.redirect != "" {
+			s.logger.Info("redirect listening", "addr", l.ln.Addr().String(), "to", l.redirect)
+			lns[i].handler = s.RedirectHandler(l.redirect)
+			continue
+		}
+		s.logger.Info("server listening", "addr", l.ln.Addr().String())
+		if l.tls && !extendedConnectEnabled() {
+			s.logger.Warn("websockets over HTTP/2 disabled, run with GODEBUG=http2xconnect=1 to enable them",
+				"addr", l.ln.Addr().String())
+		}
+	}
+	mux.Handle("/", s)
+	mux.Handle("/sink", s.SinkHandler())
+	mux.Handle("/stream", s.StreamHandler())
+	mux.Handle("/sse", s.SSEHandler())
+	mux.Handle("/sockjs", s.SockJSHandler())
+	mux.Handle("/sockjs/", s.SockJSHandler())
+	mux.Handle("/socket.io/", s.SocketIOHandler())
+	mux.Handle("/stomp", s.STOMPHandler())
+	mux.Handle("/broadcast", s.BroadcastHandler())
+	mux.Handle("/broadcast/", s.BroadcastHandler())
+	if h := s.MetricsHandler(); h != nil {
+		mux.Handle("/metrics", h)
+	}
+	if h := s.ExpvarHandler(); h != nil {
+		mux.Handle("/debug/vars", h)
+	}
+	if h := s.StatsHandler(); h != nil {
+		mux.Handle("/stats", h)
+	}
+	if h := s.DashboardHandler(); h != nil {
+		mux.Handle("/dashboard", h)
+		mux.Handle("/dashboard/", h)
+	}
+	mux.Handle("/health", s.HealthHandler())
+	mux.Handle("/livez", s.LivenessHandler())
+	mux.Handle("/readyz", s.ReadinessHandler())
 
-	// Ping pong handlers
-	conn.SetPingHandler(func(appData string) error {
-		// Send pong
-		log.Printf("ping: %s\n", appData)
-		return conn.WriteMessage(websocket.PongMessage, []byte(appData))
-	})
-	conn.SetPongHandler(func(appData string) error {
-		log.Printf("pong: %s\n", appData)
-		return nil
-	})
-
-	// Close handler
-	conn.SetCloseHandler(func(code int, text string) error {
-		log.Printf("close: %d %s\n", code, text)
-		cancel()
-		return nil
-	})
-
-	// Echo messages
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		mt, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Println(fmt.Errorf("couldn't read: %w", err))
-			break
+	// Drain on signals and shut down once drained.
+	if len(s.drainSignals) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, s.drainSignals...)
+		defer signal.Stop(sigs)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+			case sig := <-sigs:
+				s.logger.Info("signal received", "signal", sig.String())
+				s.Drain(ctx)
+				cancel()
+			}
+		}()
+	}
+	if err := s.serveAdmin(ctx); err != nil {
+		for _, l := range lns {
+			_ = l.ln.Close()
 		}
-		log.Printf("recv: %d bytes", len(message))
-		if err := conn.WriteMessage(mt, message); err != nil {
-			log.Println(fmt.Errorf("couldn't write: %w", err))
-			break
+		return err
+	}
+	// WebTransport sessions and TCP echo connections are closed along with
+	// the websocket connections, before the server stops.
+	stopWebTransport, err := s.serveWebTransport()
+	if err != nil {
+		for _, l := range lns {
+			_ = l.ln.Close()
 		}
+		return err
 	}
+	defer stopWebTransport()
+	stopTCPEcho, err := s.serveTCPEcho()
+	if err != nil {
+		for _, l := range lns {
+			_ = l.ln.Close()
+		}
+		return err
+	}
+	defer stopTCPEcho()
+	stopUDPEcho, err := s.serveUDPEcho()
+	if err != nil {
+		for _, l := range lns {
+			_ = l.ln.Close()
+		}
+		return err
+	}
+	defer stopUDPEcho()
+	return serveHandler(ctx, lns, mux, s.logger, s.Shutdown)
 }
 
-func Ping(ctx context.Context, host string, n, size int, insecure bool) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// shutdownTimeout is the maximum time to close the hijacked connections on
+// shutdown, and then to shut down the http servers.
+const shutdownTimeout = 5 * time.Second
 
-	// Create a new dialer.
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 5 * time.Second,
-		// Skip TLS verification.
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+// serveHandler serves h on the listeners until the context is cancelled or
+// any of them fails. The shutdown function, if not nil, is called once
+// before shutting down the http servers to close the connections hijacked
+// from them.
+func serveHandler(ctx context.Context, lns []listener, h http.Handler, logger *slog.Logger,
+	shutdown func(context.Context) error) error {
+	// Create a new server for each listener.
+	srvs := make([]*http.Server, 0, len(lns))
+	for _, l := range lns {
+		handler := h
+		if l.handler != nil {
+			handler = l.handler
+		}
+		srvs = append(srvs, &http.Server{
+			Addr:    l.ln.Addr().String(),
+			Handler: handler,
+		})
 	}
 
-	// Dial the host.
-	conn, _, err := dialer.Dial(host, nil)
-	if err != nil {
-		return fmt.Errorf("couldn't dial: %w", err)
-	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Println(fmt.Errorf("couldn't close: %w", err))
+	// Listen until the context is cancelled.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		logger.Info("server shutting down")
+		// The hijacked connections and the http servers get their own
+		// timeout, so slow connections don't cut the shutdown of the servers.
+		if shutdown != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := shutdown(ctx); err != nil {
+				logger.Error("couldn't close connections", "error", err)
+			}
+			cancel()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		for _, srv := range srvs {
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error("couldn't shutdown", "addr", srv.Addr, "error", err)
+			}
 		}
 	}()
 
-	// Ping pong handlers
-	conn.SetPingHandler(func(appData string) error {
-		// Send pong
-		log.Printf("ping: %s\n", appData)
-		return conn.WriteMessage(websocket.PongMessage, []byte(appData))
-	})
-	conn.SetPongHandler(func(appData string) error {
-		log.Printf("pong: %s\n", appData)
-		return nil
-	})
-
-	// Close handler
-	conn.SetCloseHandler(func(code int, text string) error {
-		log.Printf("close: %d %s\n", code, text)
-		cancel()
-		return nil
-	})
-
-	// Send data
-	var elapseds []time.Duration
-	for i := 0; i < n; i++ {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-		}
-		start := time.Now()
-		if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, size)); err != nil {
-			return fmt.Errorf("couldn't write: %w", err)
-		}
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			log.Println(fmt.Errorf("couldn't read: %w", err))
-			break
-		}
-		elapsed := time.Since(start)
-		elapseds = append(elapseds, elapsed)
-		log.Printf("sent %d bytes in %s\n", size, elapsed)
+	errs := make(chan error, len(lns))
+	for i, l := range lns {
+		go func(srv *http.Server, l listener) {
+			err := l.run(srv, l.ln)
+			if err != nil && err != http.ErrServerClosed {
+				// Stop serving the other listeners.
+				cancel()
+				errs <- fmt.Errorf("couldn't serve %s: %w", srv.Addr, err)
+				return
+			}
+			errs <- nil
+		}(srvs[i], l)
 	}
-
-	// Print average
-	if len(elapseds) > 0 {
-		var sum time.Duration
-		for _, d := range elapseds {
-			sum += d
+	var err error
+	for range lns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
 		}
-		log.Println("average:")
-		log.Printf("sent %d bytes in %s\n", size*len(elapseds), sum/time.Duration(len(elapseds)))
 	}
-	return nil
+	cancel()
+	<-done
+	return err
 }